@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultsPath returns the tools' own settings file, which admins can use to
+// restrict what ssh-add-host writes and users to define contexts.
+// $SSH_TOOLS_DEFAULTS overrides the location.
+func defaultsPath() string {
+	if path := os.Getenv("SSH_TOOLS_DEFAULTS"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "my-ssh-tools", "defaults")
+}
+
+// toolDefaults holds the settings read from the defaults file. It uses the
+// ssh config syntax:
+//
+//	AllowDirective ForwardAgent ServerAliveInterval
+//	DenyDirective StrictHostKeyChecking no
+//	Context work ~/.ssh/config.work
+//
+// AllowDirective lines, if any, list the only directives -o, --set,
+// --defaults and --import may write.
+// DenyDirective rejects a directive, or only the given value of it.
+// Context names a config file, or a directory holding a "config" file, for
+// --context.
+type toolDefaults struct {
+	path     string
+	allow    map[string]bool
+	deny     []directive
+	contexts []directive // name and path, in file order
+}
+
+// loadDefaults reads the defaults file. A missing file yields permissive
+// defaults.
+func loadDefaults() (toolDefaults, error) {
+	d := toolDefaults{path: defaultsPath()}
+	if d.path == "" {
+		return d, nil
+	}
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	} else if err != nil {
+		return d, err
+	}
+
+	for n, line := range strings.Split(string(data), "\n") {
+		k, v, ok := parseDirective(line)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "allowdirective":
+			if d.allow == nil {
+				d.allow = map[string]bool{}
+			}
+			for _, name := range strings.Fields(v) {
+				d.allow[strings.ToLower(name)] = true
+			}
+		case "denydirective":
+			fields := strings.Fields(v)
+			if len(fields) == 0 {
+				return d, fmt.Errorf("%s line %d: DenyDirective needs a directive name", d.path, n+1)
+			}
+			d.deny = append(d.deny, directive{fields[0], strings.Join(fields[1:], " ")})
+		case "context":
+			fields := strings.Fields(v)
+			if len(fields) < 2 {
+				return d, fmt.Errorf("%s line %d: Context needs a name and a path", d.path, n+1)
+			}
+			d.contexts = append(d.contexts, directive{fields[0], strings.TrimSpace(v[len(fields[0]):])})
+		default:
+			return d, fmt.Errorf("%s line %d: unknown setting %q", d.path, n+1, k)
+		}
+	}
+	return d, nil
+}
+
+// check returns an error if the defaults forbid writing dir. Every path
+// that writes a directive of the user's choosing (-o, --set, --defaults and
+// --import) goes through it.
+func (d toolDefaults) check(dir directive) error {
+	if d.allow != nil && !d.allow[strings.ToLower(dir.Key)] {
+		return fmt.Errorf("directive %s is not in the allowlist in %s", dir.Key, d.path)
+	}
+	for _, deny := range d.deny {
+		if !strings.EqualFold(deny.Key, dir.Key) {
+			continue
+		}
+		if deny.Value == "" || strings.EqualFold(deny.Value, dir.Value) {
+			return fmt.Errorf("directive \"%s %s\" is denied by %s", dir.Key, dir.Value, d.path)
+		}
+	}
+	return nil
+}
+
+// contextConfig returns the config file of the named context: the path
+// given for it, or the "config" file inside it if that is a directory. A
+// directory without one is an error rather than an empty new config, since
+// its other files would silently be ignored.
+func (d toolDefaults) contextConfig(name string) (string, error) {
+	for _, c := range d.contexts {
+		if c.Key != name {
+			continue
+		}
+		path := sshPath(c.Value)
+		if !isDir(path) {
+			return path, nil
+		}
+		config := filepath.Join(path, "config")
+		if _, err := os.Stat(config); err != nil {
+			return "", fmt.Errorf("context %q is the directory %s, which has no config file; create %s (it can Include %s)",
+				name, path, config, filepath.Join(path, "*.conf"))
+		}
+		return config, nil
+	}
+	return "", fmt.Errorf("unknown context %q (see --list-contexts)", name)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDefaultsSeparators(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defaults")
+	writeFile(t, path, "DenyDirective\tStrictHostKeyChecking \t no\nDenyDirective ForwardAgent\nContext\twork  ~/My Configs/work\n")
+	t.Setenv("SSH_TOOLS_DEFAULTS", path)
+
+	d, err := loadDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.check(directive{"StrictHostKeyChecking", "no"}); err == nil {
+		t.Error("StrictHostKeyChecking no was not denied")
+	}
+	if err := d.check(directive{"StrictHostKeyChecking", "yes"}); err != nil {
+		t.Errorf("StrictHostKeyChecking yes: %v", err)
+	}
+	if err := d.check(directive{"ForwardAgent", "yes"}); err == nil {
+		t.Error("ForwardAgent was not denied")
+	}
+	want := directive{"work", "~/My Configs/work"}
+	if len(d.contexts) != 1 || d.contexts[0] != want {
+		t.Errorf("contexts = %v, want [%v]", d.contexts, want)
+	}
+}
+
+func TestContextConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.work")
+	withConfig := filepath.Join(dir, "lab.d")
+	withoutConfig := filepath.Join(dir, "empty.d")
+	for _, d := range []string{withConfig, withoutConfig} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(withConfig, "config"), "Include "+withConfig+"/*.conf\n")
+	writeFile(t, filepath.Join(withoutConfig, "web.conf"), "Host web\n")
+
+	d := toolDefaults{contexts: []directive{
+		{"work", file},
+		{"lab", withConfig},
+		{"empty", withoutConfig},
+	}}
+	tests := []struct {
+		name, want string
+		wantErr    bool
+	}{
+		{"work", file, false},
+		{"lab", filepath.Join(withConfig, "config"), false},
+		{"empty", "", true},
+		{"missing", "", true},
+	}
+	for _, tt := range tests {
+		got, err := d.contextConfig(tt.name)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("contextConfig(%s) = %q, %v; want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
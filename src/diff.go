@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// directiveChange is a directive whose value differs between two configs.
+// An empty value means the directive is not set on that side.
+type directiveChange struct {
+	Key string `json:"key"`
+	A   string `json:"a"`
+	B   string `json:"b"`
+}
+
+// hostDiff lists the directives that differ for an alias in both configs.
+type hostDiff struct {
+	Alias   string            `json:"alias"`
+	Changes []directiveChange `json:"changes"`
+}
+
+// profileDiff is the result of comparing two configs.
+type profileDiff struct {
+	OnlyA     []string   `json:"only_a"`
+	OnlyB     []string   `json:"only_b"`
+	Different []hostDiff `json:"different"`
+}
+
+// blockSettings returns the directives of alias's own Host block, keyed by
+// lower-cased keyword. Repeated keywords are joined with ", ".
+func blockSettings(lines []string, alias string) (map[string]string, []string) {
+	b, ok := findBlock(lines, alias)
+	if !ok {
+		return nil, nil
+	}
+	settings := map[string]string{}
+	var keys []string
+	for _, line := range lines[b.Start+1 : b.End] {
+		k, v, ok := parseDirective(line)
+		if !ok {
+			continue
+		}
+		lk := strings.ToLower(k)
+		if old, seen := settings[lk]; seen {
+			settings[lk] = old + ", " + v
+			continue
+		}
+		settings[lk] = v
+		keys = append(keys, k)
+	}
+	return settings, keys
+}
+
+// diffProfiles compares the hosts of two configs: aliases only in a, only in
+// b, and those in both whose blocks set different directives.
+func diffProfiles(a, b string) (profileDiff, error) {
+	d := profileDiff{OnlyA: []string{}, OnlyB: []string{}, Different: []hostDiff{}}
+	var lines [2][]string
+	var hosts [2][]string
+	for i, path := range []string{a, b} {
+		var err error
+		if lines[i], err = readConfigLines(path); err != nil {
+			return d, err
+		}
+		if hosts[i], err = listHosts(path); err != nil {
+			return d, err
+		}
+	}
+
+	for _, h := range hosts[0] {
+		if !slices.Contains(hosts[1], h) {
+			d.OnlyA = append(d.OnlyA, h)
+			continue
+		}
+		sa, keys := blockSettings(lines[0], h)
+		sb, keysB := blockSettings(lines[1], h)
+		for _, k := range keysB {
+			if _, ok := sa[strings.ToLower(k)]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		hd := hostDiff{Alias: h}
+		for _, k := range keys {
+			lk := strings.ToLower(k)
+			if sa[lk] != sb[lk] {
+				hd.Changes = append(hd.Changes, directiveChange{Key: k, A: sa[lk], B: sb[lk]})
+			}
+		}
+		if len(hd.Changes) > 0 {
+			d.Different = append(d.Different, hd)
+		}
+	}
+	for _, h := range hosts[1] {
+		if !slices.Contains(hosts[0], h) {
+			d.OnlyB = append(d.OnlyB, h)
+		}
+	}
+	return d, nil
+}
+
+// printProfileDiff prints d for configs a and b, as JSON with asJSON. It
+// returns whether the configs differ.
+func printProfileDiff(d profileDiff, a, b string, asJSON bool) (bool, error) {
+	differ := len(d.OnlyA)+len(d.OnlyB)+len(d.Different) > 0
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return differ, enc.Encode(d)
+	}
+	if !differ {
+		fmt.Println("No differences.")
+		return false, nil
+	}
+	unset := func(v string) string {
+		if v == "" {
+			return "(not set)"
+		}
+		return v
+	}
+	for _, side := range []struct {
+		path  string
+		hosts []string
+	}{{a, d.OnlyA}, {b, d.OnlyB}} {
+		if len(side.hosts) == 0 {
+			continue
+		}
+		fmt.Printf("Only in %s:\n", side.path)
+		for _, h := range side.hosts {
+			fmt.Printf("  %s\n", h)
+		}
+	}
+	if len(d.Different) > 0 {
+		fmt.Println("Different:")
+		for _, hd := range d.Different {
+			fmt.Printf("  %s\n", hd.Alias)
+			for _, c := range hd.Changes {
+				fmt.Printf("    %s: %s → %s\n", c.Key, unset(c.A), unset(c.B))
+			}
+		}
+	}
+	return true, nil
+}
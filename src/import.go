@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// importColumns is the column order of an import file without a header row.
+var importColumns = []string{"alias", "hostname", "user", "port", "identityfile", "proxyjump"}
+
+// importResult records what happened to one host of a batch import.
+type importResult struct {
+	Alias   string `json:"alias"`
+	Status  string `json:"status"` // added, overwritten or skipped
+	Reason  string `json:"reason,omitempty"`
+	Keyscan string `json:"keyscan_error,omitempty"`
+}
+
+// importRecord is one host of a JSON import file.
+type importRecord struct {
+	Alias        string `json:"alias"`
+	HostName     string `json:"hostname"`
+	User         string `json:"user"`
+	Port         any    `json:"port"` // number or string
+	IdentityFile string `json:"identityfile"`
+	ProxyJump    string `json:"proxyjump"`
+}
+
+// importFormat returns format, or guesses it from the file extension.
+func importFormat(path, format string) (string, error) {
+	switch format {
+	case "csv", "json":
+		return format, nil
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			return "json", nil
+		}
+		return "csv", nil
+	}
+	return "", fmt.Errorf("--import-format must be csv or json, not %q", format)
+}
+
+// readImportJSON reads hosts from a JSON array of objects. Each object must
+// have alias, hostname and user and no unknown fields; a record that does
+// not is returned with only an "error" entry naming its index.
+func readImportJSON(path string) ([]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: expected a JSON array of hosts: %w", path, err)
+	}
+
+	var rows []map[string]string
+	for i, msg := range raw {
+		var rec importRecord
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&rec)
+		var missing []string
+		for _, f := range []struct{ name, value string }{{"alias", rec.Alias}, {"hostname", rec.HostName}, {"user", rec.User}} {
+			if f.value == "" {
+				missing = append(missing, f.name)
+			}
+		}
+		port := ""
+		switch p := rec.Port.(type) {
+		case nil:
+		case float64:
+			port = strconv.FormatFloat(p, 'f', -1, 64)
+		case string:
+			port = p
+		default:
+			err = fmt.Errorf("port must be a number or string")
+		}
+		switch {
+		case err != nil:
+			rows = append(rows, map[string]string{"alias": rec.Alias, "error": fmt.Sprintf("record %d: %v", i, err)})
+		case len(missing) > 0:
+			rows = append(rows, map[string]string{"alias": rec.Alias, "error": fmt.Sprintf("record %d: missing %s", i, strings.Join(missing, ", "))})
+		default:
+			rows = append(rows, map[string]string{
+				"alias": rec.Alias, "hostname": rec.HostName, "user": rec.User, "port": port,
+				"identityfile": rec.IdentityFile, "proxyjump": rec.ProxyJump,
+			})
+		}
+	}
+	return rows, nil
+}
+
+// readImport reads hosts from a CSV file, one per row. A first row starting
+// with "alias" is a header naming the columns; otherwise the columns are
+// those of importColumns.
+func readImport(path string) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	cols := importColumns
+	var rows []map[string]string
+	for first := true; ; first = false {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && len(rec) > 0 && strings.EqualFold(strings.TrimSpace(rec[0]), "alias") {
+			cols = make([]string, len(rec))
+			for i, c := range rec {
+				cols[i] = strings.ToLower(strings.TrimSpace(c))
+			}
+			continue
+		}
+		row := map[string]string{}
+		for i, v := range rec {
+			if i < len(cols) {
+				row[cols[i]] = strings.TrimSpace(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// importHost writes the host currently held in the flag variables to
+// config, as a batch version of the interactive flow: nothing is prompted
+// and problems, including -o directives the tool defaults forbid, skip the
+// host instead of stopping the run.
+func importHost(config string, done map[string]bool) importResult {
+	res := importResult{Alias: alias, Status: "skipped"}
+	switch {
+	case alias == "" || hostname == "" || username == "":
+		res.Reason = "alias, hostname and user are required"
+		return res
+	case done[alias]:
+		res.Reason = "listed more than once"
+		return res
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		res.Reason = fmt.Sprintf("invalid port %q", port)
+		return res
+	}
+	for _, d := range extras {
+		if err := addDefaults.check(d); err != nil {
+			res.Reason = err.Error()
+			return res
+		}
+	}
+	if err := checkUser(username); err != nil && !force {
+		res.Reason = err.Error()
+		return res
+	}
+
+	files := configFiles(config, config)
+	owners, prevLines, prev := findOwners(files, alias)
+	for _, f := range owners {
+		if handWritten(f, alias) {
+			res.Reason = "defined outside the managed region"
+			return res
+		}
+	}
+	if len(owners) > 0 && !force {
+		res.Reason = "already exists (use -f to overwrite)"
+		return res
+	}
+	if aliasClash(files, alias, hostname) != "" && !force {
+		res.Reason = fmt.Sprintf("HostName %s is an existing alias", hostname)
+		return res
+	}
+
+	if len(owners) > 0 {
+		if knownFile == "" {
+			knownFile = blockComment(prevLines, prev, "known-hosts")
+		}
+		if become == "" {
+			become = blockComment(prevLines, prev, "become")
+		}
+	}
+	for _, f := range owners {
+		if err := removeExistingAlias(f, alias); err != nil {
+			res.Reason = err.Error()
+			return res
+		}
+	}
+	if err := appendBlock(config); err != nil {
+		res.Reason = err.Error()
+		return res
+	}
+	done[alias] = true
+	res.Status = "added"
+	if len(owners) > 0 {
+		res.Status = "overwritten"
+	}
+
+	if strings.ToLower(addKnown) == "yes" {
+		if err := addKnownHosts(config, alias, hostname, port, hashKnownHosts(config, alias), knownFile); err != nil {
+			res.Keyscan = err.Error()
+		}
+	}
+	return res
+}
+
+// runImport adds every host of a CSV or JSON file and prints a summary of
+// what was added, overwritten or skipped, as a table or, with summaryJSON,
+// as JSON.
+func runImport(path, format string, summaryJSON bool) {
+	format, err := importFormat(path, format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var rows []map[string]string
+	if format == "json" {
+		rows, err = readImportJSON(path)
+	} else {
+		rows, err = readImport(path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := ensureConfig()
+	if data, err := os.ReadFile(config); err == nil && len(rows) > 0 {
+		if err := backupConfig(config, data); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var results []importResult
+	done := map[string]bool{}
+	flagKnown, flagBecome := knownFile, become
+	for _, row := range rows {
+		if row["error"] != "" {
+			results = append(results, importResult{Alias: row["alias"], Status: "skipped", Reason: row["error"]})
+			continue
+		}
+		knownFile, become = flagKnown, flagBecome
+		alias, hostname, username = row["alias"], row["hostname"], row["user"]
+		port, idfile, proxyjump = row["port"], row["identityfile"], row["proxyjump"]
+		if username == "" {
+			username = os.Getenv("USER")
+		}
+		if port == "" {
+			port = "22"
+		}
+		results = append(results, importHost(config, done))
+	}
+
+	counts := map[string]int{}
+	failures := 0
+	for _, r := range results {
+		counts[r.Status]++
+		if r.Keyscan != "" {
+			failures++
+		}
+	}
+
+	if summaryJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Config          string         `json:"config"`
+			Added           int            `json:"added"`
+			Overwritten     int            `json:"overwritten"`
+			Skipped         int            `json:"skipped"`
+			KeyscanFailures int            `json:"keyscan_failures"`
+			Hosts           []importResult `json:"hosts"`
+		}{config, counts["added"], counts["overwritten"], counts["skipped"], failures, results})
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ALIAS\tRESULT\tDETAIL")
+		for _, r := range results {
+			detail := r.Reason
+			if r.Keyscan != "" {
+				detail = "keyscan failed: " + r.Keyscan
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Alias, r.Status, detail)
+		}
+		tw.Flush()
+		fmt.Printf("\n%d added, %d overwritten, %d skipped, %d keyscan failure(s) in %s.\n",
+			counts["added"], counts["overwritten"], counts["skipped"], failures, config)
+	}
+
+	if counts["skipped"] > 0 || failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func knownHostsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("cannot get home dir: %v", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// knownHostsStats counts the entries of a known_hosts file and returns the
+// line numbers of duplicate and malformed entries.
+func knownHostsStats(path string) (entries int, dups, malformed []int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		want := 3
+		if strings.HasPrefix(fields[0], "@") {
+			want = 4
+		}
+		if len(fields) < want {
+			malformed = append(malformed, n)
+			continue
+		}
+		entries++
+		key := strings.Join(fields, " ")
+		if seen[key] {
+			dups = append(dups, n)
+		}
+		seen[key] = true
+	}
+	return entries, dups, malformed, scanner.Err()
+}
+
+// scanKeys runs ssh-keyscan against hostname and returns the known_hosts
+// lines it printed.
+func scanKeys(hostname, port string, hash bool) ([]string, error) {
+	args := []string{"-T", "5"}
+	if hash {
+		args = append(args, "-H")
+	}
+	if port != "" && port != "22" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, hostname)
+
+	out, err := exec.Command("ssh-keyscan", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			keys = append(keys, l)
+		}
+	}
+	return keys, nil
+}
+
+// scanAttempts is how often scanWithRetry tries ssh-keyscan, waiting
+// scanRetryDelay between attempts.
+const (
+	scanAttempts   = 3
+	scanRetryDelay = 2 * time.Second
+)
+
+// scanWithRetry is scanKeys retried a few times, for hosts that are slow to
+// answer or briefly unreachable.
+func scanWithRetry(hostname, port string, hash bool) ([]string, error) {
+	var err error
+	for i := 1; ; i++ {
+		var keys []string
+		keys, err = scanKeys(hostname, port, hash)
+		if err == nil && len(keys) > 0 {
+			return keys, nil
+		}
+		if i == scanAttempts {
+			break
+		}
+		time.Sleep(scanRetryDelay)
+	}
+	if err == nil {
+		return nil, fmt.Errorf("ssh-keyscan found no keys for %s after %d attempts", hostname, scanAttempts)
+	}
+	return nil, fmt.Errorf("ssh-keyscan %s failed %d times: %w", hostname, scanAttempts, err)
+}
+
+// scanThroughJump gets the host key of alias, which sits behind a
+// ProxyJump that ssh-keyscan cannot use, by connecting with ssh through the
+// jump and letting it record the key in a scratch known_hosts file. The
+// jump host itself must already be trusted. Authentication may fail; the key
+// is recorded before it is attempted.
+func scanThroughJump(config, alias string) ([]string, error) {
+	f, err := os.CreateTemp("", "ssh-add-host-known-*")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cmd := exec.Command("ssh", "-F", config,
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile="+f.Name(),
+		alias, "true")
+	out, _ := cmd.CombinedOutput()
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			keys = append(keys, l)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("ssh through the jump host recorded no key for %s: %s", alias, strings.TrimSpace(string(out)))
+	}
+	return keys, nil
+}
+
+// fingerprint returns the key type and SHA256 fingerprint of a known_hosts
+// line, in the form ssh-keygen -l prints.
+func fingerprint(line string) (keyType, fp string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return "", "", fmt.Errorf("malformed key line %q", line)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(blob)
+	return fields[1], "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// appendKnownHosts appends the keys not already present in known_hosts,
+// leaving existing lines, their order and comments untouched.
+func appendKnownHosts(known string, keys []string) error {
+	data, err := os.ReadFile(known)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	have := map[string]bool{}
+	for _, l := range strings.Split(string(data), "\n") {
+		have[strings.TrimSpace(l)] = true
+	}
+
+	var b strings.Builder
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		b.WriteString("\n")
+	}
+	added := 0
+	for _, k := range keys {
+		if !have[k] {
+			have[k] = true
+			b.WriteString(k + "\n")
+			added++
+		}
+	}
+	if added == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(known, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(b.String())
+	return err
+}
+
+// forgetHost removes every known_hosts entry for hostname (on port, if not
+// 22), hashed or not, using ssh-keygen -R.
+func forgetHost(known, hostname, port string) error {
+	name := hostname
+	if port != "" && port != "22" {
+		name = fmt.Sprintf("[%s]:%s", hostname, port)
+	}
+	out, err := exec.Command("ssh-keygen", "-R", name, "-f", known).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ssh-keygen -R %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	os.Remove(known + ".old")
+	return nil
+}
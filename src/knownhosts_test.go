@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHashKnownHosts(t *testing.T) {
+	tests := []struct {
+		name, config string
+		want         bool
+	}{
+		{"set globally", "Host *\n    HashKnownHosts yes\n\nHost web\n    HostName 10.0.0.1\n", true},
+		{"set per host", "Host web\n    HostName 10.0.0.1\n    HashKnownHosts yes\n", true},
+		{"set for another host", "Host db\n    HashKnownHosts yes\n\nHost web\n    HostName 10.0.0.1\n", false},
+		{"absent", "Host web\n    HostName 10.0.0.1\n", false},
+		{"set to no", "Host web\n    HashKnownHosts no\n", false},
+		{"host no before global yes", "Host web\n    HashKnownHosts no\n\nHost *\n    HashKnownHosts yes\n", false},
+		{"global yes before host no", "Host *\n    HashKnownHosts yes\n\nHost web\n    HashKnownHosts no\n", true},
+		{"case-insensitive", "Host web\n    hashknownhosts Yes\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), "config")
+			writeFile(t, config, tt.config)
+			if got := hashKnownHosts(config, "web"); got != tt.want {
+				t.Errorf("hashKnownHosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if hashKnownHosts(filepath.Join(t.TempDir(), "missing"), "web") {
+		t.Error("hashKnownHosts is true for a missing config")
+	}
+}
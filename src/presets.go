@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// preset pre-fills the fields of a common kind of host for --preset. Its
+// values become the prompt defaults, so flags and answers still win; its
+// extra directives are added unless -o sets the same key.
+type preset struct {
+	Name         string
+	Description  string
+	HostName     string
+	User         string
+	Port         string
+	IdentityFile string
+	Extras       []directive
+}
+
+// presets are the built-in --preset values. Add an entry here for a new
+// one; --list-presets prints them all.
+var presets = []preset{
+	{
+		Name:         "aws-ec2",
+		Description:  "Amazon Linux on EC2",
+		User:         "ec2-user",
+		IdentityFile: "~/.ssh/aws.pem",
+		Extras:       []directive{{Key: "ForwardAgent", Value: "no"}},
+	},
+	{
+		Name:         "aws-ubuntu",
+		Description:  "Ubuntu on EC2",
+		User:         "ubuntu",
+		IdentityFile: "~/.ssh/aws.pem",
+		Extras:       []directive{{Key: "ForwardAgent", Value: "no"}},
+	},
+	{
+		Name:         "gcp",
+		Description:  "Google Compute Engine, with the key gcloud compute ssh creates",
+		IdentityFile: "~/.ssh/google_compute_engine",
+		Extras:       []directive{{Key: "ForwardAgent", Value: "no"}},
+	},
+	{
+		Name:         "azure",
+		Description:  "Azure virtual machine",
+		User:         "azureuser",
+		IdentityFile: "~/.ssh/id_rsa",
+		Extras:       []directive{{Key: "ForwardAgent", Value: "no"}},
+	},
+	{
+		Name:        "raspberry-pi",
+		Description: "Raspberry Pi OS on the local network",
+		HostName:    "raspberrypi.local",
+		User:        "pi",
+	},
+	{
+		Name:        "vagrant",
+		Description: "Local Vagrant box (its host key changes with every box)",
+		HostName:    "127.0.0.1",
+		User:        "vagrant",
+		Port:        "2222",
+		Extras: []directive{
+			{Key: "StrictHostKeyChecking", Value: "no"},
+			{Key: "UserKnownHostsFile", Value: "/dev/null"},
+		},
+	},
+}
+
+// findPreset returns the preset called name.
+func findPreset(name string) (preset, error) {
+	for _, p := range presets {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return preset{}, fmt.Errorf("unknown preset %q (see --list-presets)", name)
+}
+
+// listPresets prints the name, description and settings of every preset.
+func listPresets() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRESET\tDESCRIPTION\tSETTINGS")
+	for _, p := range presets {
+		var settings []string
+		for _, d := range append([]directive{
+			{Key: "HostName", Value: p.HostName},
+			{Key: "User", Value: p.User},
+			{Key: "Port", Value: p.Port},
+			{Key: "IdentityFile", Value: p.IdentityFile},
+		}, p.Extras...) {
+			if d.Value != "" {
+				settings = append(settings, d.Key+"="+d.Value)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Name, p.Description, strings.Join(settings, " "))
+	}
+	tw.Flush()
+}
+
+// applyPresetExtras adds the preset's extra directives that -o did not set.
+func applyPresetExtras(p preset) {
+	for _, d := range p.Extras {
+		set := false
+		for _, e := range extras {
+			if strings.EqualFold(e.Key, d.Key) {
+				set = true
+			}
+		}
+		if !set {
+			extras = append(extras, d)
+		}
+	}
+}
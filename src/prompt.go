@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func prompt(current *string, msg, def string) {
+	if *current != "" {
+		return
+	}
+	if nonInteractive {
+		*current = def
+		return
+	}
+	text := fmt.Sprintf("%s: ", msg)
+	if def != "" {
+		text = fmt.Sprintf("%s [%s]: ", msg, def)
+	}
+	line, err := editLine(text, loadPromptHistory(msg))
+	if errors.Is(err, errNoTerminal) {
+		fmt.Print(text)
+		line, _ = stdin.ReadString('\n')
+	}
+	line = strings.TrimSpace(line)
+	if err == nil && line != "" {
+		savePromptHistory(msg, line)
+	}
+	if line == "" && def != "" {
+		line = def
+	}
+	*current = line
+}
+
+var errNoTerminal = errors.New("stdin is not a terminal")
+
+// stty runs stty against the terminal on stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminalHeight returns the number of rows of the terminal on stdin, or 0
+// if it cannot be determined.
+func terminalHeight() int {
+	if out, err := stty("size"); err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscan(out, &rows, &cols); err == nil {
+			return rows
+		}
+	}
+	var rows int
+	fmt.Sscan(os.Getenv("LINES"), &rows)
+	return rows
+}
+
+// rawMode switches the terminal to raw mode and returns a function that
+// restores the previous settings.
+func rawMode() (func(), error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, errNoTerminal
+	}
+	state, err := stty("-g")
+	if err != nil {
+		return nil, errNoTerminal
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		stty(state)
+		return nil, errNoTerminal
+	}
+	return func() { stty(state) }, nil
+}
+
+// editLine reads a line from the terminal with basic editing: Left/Right,
+// Home/End, Backspace/Delete, Ctrl-A/E/K/U/W, and Up/Down to recall
+// history (oldest first). It returns errNoTerminal if stdin is not a
+// terminal it can switch to raw mode.
+func editLine(text string, history []string) (string, error) {
+	restore, err := rawMode()
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	var buf, draft []rune
+	pos, hist := 0, len(history)
+	recall := func(i int) {
+		if hist == len(history) {
+			draft = append([]rune{}, buf...)
+		}
+		hist = i
+		if hist == len(history) {
+			buf = draft
+		} else {
+			buf = []rune(history[hist])
+		}
+		pos = len(buf)
+	}
+
+	for {
+		fmt.Printf("\r%s%s\x1b[K", text, string(buf))
+		if n := len(buf) - pos; n > 0 {
+			fmt.Printf("\x1b[%dD", n)
+		}
+
+		r, _, err := stdin.ReadRune()
+		if err != nil {
+			fmt.Print("\r\n")
+			return string(buf), err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Print("^C\r\n")
+			restore()
+			os.Exit(130)
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Print("\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(buf) {
+				pos++
+			}
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf, pos = append([]rune{}, buf[pos:]...), 0
+		case 23: // Ctrl-W
+			i := pos
+			for i > 0 && buf[i-1] == ' ' {
+				i--
+			}
+			for i > 0 && buf[i-1] != ' ' {
+				i--
+			}
+			buf, pos = append(buf[:i], buf[pos:]...), i
+		case 8, 127: // Backspace
+			if pos > 0 {
+				buf, pos = append(buf[:pos-1], buf[pos:]...), pos-1
+			}
+		case 27:
+			switch readEscape() {
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+				}
+			case "[C", "OC":
+				if pos < len(buf) {
+					pos++
+				}
+			case "[H", "OH", "[1~", "[7~":
+				pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				pos = len(buf)
+			case "[3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			case "[A", "OA":
+				if hist > 0 {
+					recall(hist - 1)
+				}
+			case "[B", "OB":
+				if hist < len(history) {
+					recall(hist + 1)
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+	}
+}
+
+// readEscape reads the rest of a CSI or SS3 escape sequence after ESC.
+func readEscape() string {
+	r, _, err := stdin.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	seq := []rune{r}
+	for {
+		c, _, err := stdin.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7e {
+			return string(seq)
+		}
+	}
+}
+
+// promptHistoryPath returns the file remembering previous prompt answers.
+func promptHistoryPath() string {
+	return filepath.Join(stateDir(), "prompt-history")
+}
+
+// maxPromptHistory is how many answers are remembered per prompt.
+const maxPromptHistory = 20
+
+// readPromptHistory returns all remembered answers as (prompt, answer)
+// pairs, oldest first. The file holds one "prompt<TAB>answer" line each.
+func readPromptHistory() [][2]string {
+	data, err := os.ReadFile(promptHistoryPath())
+	if err != nil {
+		return nil
+	}
+	var entries [][2]string
+	for _, line := range strings.Split(string(data), "\n") {
+		if msg, answer, ok := strings.Cut(line, "\t"); ok {
+			entries = append(entries, [2]string{msg, answer})
+		}
+	}
+	return entries
+}
+
+// loadPromptHistory returns the remembered answers for a prompt, oldest
+// first.
+func loadPromptHistory(msg string) []string {
+	var answers []string
+	for _, e := range readPromptHistory() {
+		if e[0] == msg {
+			answers = append(answers, e[1])
+		}
+	}
+	return answers
+}
+
+// savePromptHistory remembers answer for a prompt, moving repeats to the
+// end and dropping the oldest answers beyond maxPromptHistory.
+func savePromptHistory(msg, answer string) {
+	path := promptHistoryPath()
+	entries := readPromptHistory()
+	count := 0
+	for _, e := range entries {
+		if e[0] == msg && e[1] != answer {
+			count++
+		}
+	}
+
+	var b strings.Builder
+	for _, e := range entries {
+		if e[0] == msg {
+			if e[1] == answer {
+				continue
+			}
+			if count >= maxPromptHistory {
+				count--
+				continue
+			}
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", e[0], e[1])
+	}
+	fmt.Fprintf(&b, "%s\t%s\n", msg, answer)
+
+	os.MkdirAll(filepath.Dir(path), 0700)
+	os.WriteFile(path, []byte(b.String()), 0600)
+}
+
+// confirm asks a yes/no question and reports whether the answer was yes.
+func confirm(msg string) bool {
+	fmt.Printf("%s [y/N]: ", msg)
+	line, _ := stdin.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,68 +10,475 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
-	"strconv"
 )
 
 var (
-	force     bool
-	alias     string
-	hostname  string
-	username  string
-	port      string
-	idfile    string
-	proxyjump string
-	addKnown  string
+	force          bool
+	assumeYes      bool
+	nonInteractive bool
+	alias          string
+	hostname       string
+	username       string
+	port           string
+	idfile         string
+	proxyjump      string
+	addKnown       string
+	indentFlag     string
+
+	defaultsMode        bool
+	serverAliveInterval string
+	addKeysToAgent      bool
+	setMode             bool
+	rotateMode          bool
+	keepDays            int
+	into                string
+	scanOnly            bool
+	keepKnownOrder      bool
+	knownFile           string
+	identityAgent       string
+	become              string
+	importFile          string
+	importFmt           string
+	summaryJSON         bool
+	alwaysPort          bool
+	managed             bool
+	sortedRegion        bool
+	presetName          string
+	listPresetsMode     bool
+	useAgent            bool
+	unsetMode           bool
+	disableMode         bool
+	enableMode          bool
+
+	extras   optionList
+	validate bool
+	logJSON  bool
+
+	verifyKeys   bool
+	expectedKeys fingerprintList
 )
 
-func usage() {
-	prog := filepath.Base(os.Args[0])
-	fmt.Printf(`Usage: %s [-f] [-a alias] [-h hostname] [-u user] [-p port] [-i identityfile] [-P proxyjump] [--add-known-hosts yes/no]
-Prompts for any missing fields.
+// logEvent writes one JSON line describing a change to stderr when
+// --log-json is set, for pipelines that collect an audit trail.
+func logEvent(event string, fields map[string]any) {
+	if !logJSON {
+		return
+	}
+	rec := map[string]any{"time": time.Now().UTC().Format(time.RFC3339), "event": event}
+	for k, v := range fields {
+		rec[k] = v
+	}
+	json.NewEncoder(os.Stderr).Encode(rec)
+}
+
+// optionList collects repeated -o Key=Value flags as extra directives.
+type optionList []directive
+
+func (o *optionList) String() string {
+	var parts []string
+	for _, d := range *o {
+		parts = append(parts, d.Key+"="+d.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (o *optionList) Set(s string) error {
+	k, v, ok := parseDirective(s)
+	if !ok || v == "" {
+		return fmt.Errorf("expected Key=Value, got %q", s)
+	}
+	*o = append(*o, directive{k, v})
+	return nil
+}
+
+// fingerprintList collects repeated --expect-fingerprint flags. The
+// "SHA256:" prefix is optional.
+type fingerprintList []string
+
+func (f *fingerprintList) String() string { return strings.Join(*f, ",") }
+
+func (f *fingerprintList) Set(s string) error {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "SHA256:") {
+		s = "SHA256:" + s
+	}
+	if s == "SHA256:" {
+		return errors.New("empty fingerprint")
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// errUntrusted marks a keyscan whose keys were all rejected by
+// --expect-fingerprint.
+var errUntrusted = errors.New("host key not trusted")
+
+// trustKeys picks which scanned keys to add. With --expect-fingerprint only
+// keys with a listed fingerprint are kept, without asking; with
+// --verify-keys each key's fingerprint is shown and must be confirmed.
+// Otherwise all keys are trusted.
+func trustKeys(hostname string, keys []string) ([]string, error) {
+	if len(expectedKeys) == 0 && !verifyKeys {
+		return keys, nil
+	}
+	var trusted []string
+	for _, k := range keys {
+		keyType, fp, err := fingerprint(k)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(expectedKeys) > 0:
+			if !slices.Contains(expectedKeys, fp) {
+				fmt.Fprintf(os.Stderr, "Skipping %s key %s: not an expected fingerprint.\n", keyType, fp)
+				continue
+			}
+		case !confirm(fmt.Sprintf("Trust %s key %s for %s?", keyType, fp, hostname)):
+			continue
+		}
+		trusted = append(trusted, k)
+	}
+	if len(expectedKeys) > 0 && len(trusted) == 0 {
+		return nil, fmt.Errorf("%w: no key of %s matches --expect-fingerprint", errUntrusted, hostname)
+	}
+	return trusted, nil
+}
+
+// indent is the indentation used for directives in written blocks.
+var indent = "    "
+
+func addUsage() {
+	fmt.Printf(`Usage: %s [-f] [-y] [--non-interactive] [-a alias] [-h hostname] [-u user] [-p port] [-i identityfile | --use-agent] [-P proxyjump] [--add-known-hosts yes/no] [--indent N|\t] [-o Key=Value]... [--validate] [--into file] [alias [hostname [user]]]
+       %s --defaults [--server-alive-interval N] [--add-keys-to-agent]
+       %s --set alias Key Value | --unset alias Key
+       %s --disable alias | --enable alias
+       %s --import hosts.csv|hosts.json [-f] [--add-known-hosts yes] [--summary-json]
+       %s --rotate-backups [--keep-days N]
+       %s --scan-only [-h hostname] [-p port]
+Prompts for any missing fields. Positional alias, hostname and user (after the options)
+fill fields not given with -a, -h and -u; the flags win.
 
 Options:
   -f                 Overwrite existing Host alias if it exists
+  -y                 Write without asking for confirmation
+  --non-interactive  Never prompt; use defaults for missing optional fields
+  --preset name      Pre-fill User, IdentityFile and other settings for a common kind
+                     of host (e.g. aws-ec2, gcp, raspberry-pi); flags and prompts
+                     override them
+  --list-presets     List the built-in presets and their settings
   -a alias           Host alias (e.g., web-prod)
   -h hostname        HostName (IP or DNS)
   -u user            SSH user (e.g., ubuntu)
-  -p port            Port (default: 22)
+  -p port            Port (default: 22; Port 22 is not written to the block)
+  --always-write-port
+                     Write the Port line even when it is 22
   -i identityfile    Path to private key (e.g., ~/.ssh/id_ed25519)
+  --use-agent        Rely on keys in ssh-agent: write "IdentitiesOnly no" and no
+                     IdentityFile (cannot be combined with -i)
+  --identity-agent path
+                     Write IdentityAgent, e.g. a hardware-key or password-manager
+                     agent socket (warns if the socket does not exist)
   -P proxyjump       ProxyJump (e.g., bastion)
   --add-known-hosts  yes|no (default: yes) – run ssh-keyscan to pre-populate known_hosts
-`, prog)
+  --no-touch-known-hosts-order
+                     Only append new known_hosts entries; never sort, dedupe or
+                     rewrite existing lines
+  --verify-keys      Show each scanned key's SHA256 fingerprint and ask before trusting it
+  --expect-fingerprint SHA256:...
+                     Only trust scanned keys with this fingerprint, without asking
+                     (repeatable; fails if none matches)
+  --known-hosts file Scan keys into file instead of ~/.ssh/known_hosts, and record it
+                     in the block as "# known-hosts: file" (kept when overwriting)
+  --become cmd       Record "# become: cmd" (e.g. "sudo -i") for ssh-menu --become
+                     (kept when overwriting). cmd is a remote shell command line,
+                     run as written, and must be a single line
+  -o Key=Value       Extra directive for the block (repeatable, e.g. -o ForwardAgent=yes)
+                     ($SSH_TOOLS_DEFAULTS or ~/.config/my-ssh-tools/defaults may
+                     restrict these with AllowDirective/DenyDirective lines)
+  --validate         Check the block with "ssh -G" before writing (-f writes anyway)
+  --into file        Write the block to an Include file (relative to ~/.ssh), adding an
+                     Include line to the config if none covers it
+  --indent N|\t      Indent directives with N spaces or a tab (default: 4 spaces,
+                     or the existing block's style when overwriting)
+  --managed          Write the host between "# >>> ssh-tools managed >>>" and
+                     "# <<< ssh-tools managed <<<" (added at the end of the file
+                     if missing). Once a file has them, hosts are always written
+                     there, and blocks outside them are never changed or removed
+                     (also not by --set, --unset, --disable or --enable).
+  --sorted-region    Like --managed, but keep the region's blocks sorted by alias
+
+Defaults (Host * block, created at the top of the config if absent):
+  --defaults                 Edit the catch-all Host * block instead of adding a host
+  --server-alive-interval N  Set ServerAliveInterval
+  --add-keys-to-agent        Set AddKeysToAgent yes
+
+Single directives (existing hosts only, other lines are left untouched):
+  --set alias Key Value      Update or insert one directive (e.g. --set web-prod Port 2222)
+  --unset alias Key          Remove one directive
+  --disable alias            Comment out the host's block (kept in the file, ignored by ssh)
+  --enable alias             Uncomment a block disabled with --disable
+
+Batch import:
+  --import file.csv          Add every host of a CSV file (columns alias, hostname, user,
+                             port, identityfile, proxyjump, or as named by a header row),
+                             then print what was added, overwritten (-f) or skipped
+  --import file.json         Same, from a JSON array of objects with those fields
+                             (alias, hostname and user are required)
+  --import-format csv|json   File format (default: json for .json files, else csv)
+                             Hosts not in the file are left alone: there is no merge
+                             or prune mode that removes them
+  --summary-json             Print the import summary as JSON
+
+Backups:
+  --rotate-backups           Keep only the latest backup of each day
+  --keep-days N              With --rotate-backups, days of backups to keep (default: 7)
+  --backup-dir dir           Keep backups (and rotate them) in dir, created with mode 0700,
+                             instead of next to the config
+
+Inspecting host keys:
+  --scan-only                Print the keys (with SHA256 fingerprints) ssh-keyscan finds,
+                             without changing known_hosts or the config
+
+Logging:
+  --log-json                 Also write a JSON line to stderr for each change (backup created,
+                             block removed or appended, config rewritten, keyscan result)
+
+Paths:
+  --config path              SSH config to edit (default: $SSH_CONFIG or ~/.ssh/config)
+  --print-config-path        Print the config path that would be edited and exit
+  --print-known-hosts-path   Print the known_hosts path and exit
+`, prog, prog, prog, prog, prog, prog, prog)
+}
+
+// parseIndent turns an --indent value into the indentation string: a number
+// of spaces ("2"), a tab ("\t" or "tab"), or literal whitespace.
+func parseIndent(s string) (string, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 || n > 16 {
+			return "", errors.New("indent width must be between 1 and 16")
+		}
+		return strings.Repeat(" ", n), nil
+	}
+	switch s {
+	case `\t`, "tab":
+		return "\t", nil
+	}
+	if s == "" || strings.Trim(s, " \t") != "" {
+		return "", fmt.Errorf("invalid indent %q", s)
+	}
+	return s, nil
+}
+
+// checkUser reports why u is an unusual value for User: ssh would accept
+// most strings, but spaces or an @ almost always mean a paste mistake.
+func checkUser(u string) error {
+	if strings.Contains(u, "@") {
+		return fmt.Errorf("user %q contains @ (did you paste user@host?)", u)
+	}
+	for _, r := range u {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("._-$\\", r):
+		default:
+			return fmt.Errorf("user %q contains %q", u, r)
+		}
+	}
+	return nil
+}
+
+// checkBecome rejects a --become command that cannot be kept on its
+// "# become:" comment line. The value is a remote shell command line, run by
+// ssh-menu --become as given, so it is not quoted.
+func checkBecome(cmd string) error {
+	if strings.ContainsAny(cmd, "\r\n") {
+		return fmt.Errorf("--become %q must be a single line", cmd)
+	}
+	if cmd != strings.TrimSpace(cmd) {
+		return fmt.Errorf("--become %q must not start or end with whitespace", cmd)
+	}
+	return nil
 }
 
-func prompt(current *string, msg, def string) {
-	if *current != "" {
+// splitUserHost splits a pasted "user@host" into its user and host, if the
+// user part is a valid user name and the host part is not empty.
+func splitUserHost(s string) (user, host string, ok bool) {
+	user, host, ok = strings.Cut(s, "@")
+	if !ok || user == "" || host == "" || checkUser(user) != nil {
+		return "", "", false
+	}
+	return user, host, true
+}
+
+// checkIdentityAgent warns if an --identity-agent socket path does not
+// exist. Values ssh resolves itself (none, SSH_AUTH_SOCK, $VAR or %
+// tokens) are not checked.
+func checkIdentityAgent(path string) {
+	if path == "none" || path == "SSH_AUTH_SOCK" || strings.ContainsAny(path, "$%") {
 		return
 	}
-	r := bufio.NewReader(os.Stdin)
-	if def != "" {
-		fmt.Printf("%s [%s]: ", msg, def)
-	} else {
-		fmt.Printf("%s: ", msg)
+	p := expandPath(path, alias, nil)
+	fi, err := os.Stat(p)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Fprintf(os.Stderr, "Warning: IdentityAgent socket %s does not exist\n", p)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	case fi.Mode()&os.ModeSocket == 0:
+		fmt.Fprintf(os.Stderr, "Warning: IdentityAgent %s is not a socket\n", p)
 	}
-	line, _ := r.ReadString('\n')
-	line = strings.TrimSpace(line)
-	if line == "" && def != "" {
-		line = def
+}
+
+// backupDir is the --backup-dir for backups; empty keeps them next to the
+// config.
+var backupDir string
+
+// backupBase returns the path that config's backups are named after:
+// config itself, or a file of the same name in backupDir.
+func backupBase(config string) string {
+	if backupDir == "" {
+		return config
 	}
-	*current = line
+	dir := backupDir
+	if home, err := os.UserHomeDir(); err == nil && (dir == "~" || strings.HasPrefix(dir, "~/")) {
+		dir = filepath.Join(home, dir[1:])
+	}
+	return filepath.Join(dir, filepath.Base(config))
 }
 
-func sshConfigPath() string {
-	if path := os.Getenv("SSH_CONFIG"); path != "" {
-		return path
+// backedUp records the configs already backed up by this run, so the backup
+// keeps the contents from before the run's first change.
+var backedUp = map[string]bool{}
+
+// backupConfig saves data, the current contents of config, to a timestamped
+// copy next to it, or in backupDir. Only the first call per config in a run
+// writes a backup, and an existing backup is never overwritten: a second one
+// in the same second gets a counter after the timestamp.
+func backupConfig(config string, data []byte) error {
+	if backedUp[config] {
+		return nil
+	}
+	base := backupBase(config)
+	if err := os.MkdirAll(filepath.Dir(base), 0700); err != nil {
+		return err
 	}
-	home, err := os.UserHomeDir()
+	stamp := time.Now().Format("20060102-150405")
+	for n := 0; ; n++ {
+		backup := fmt.Sprintf("%s.%s.bak", base, stamp)
+		if n > 0 {
+			backup = fmt.Sprintf("%s.%s-%d.bak", base, stamp, n)
+		}
+		f, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		backedUp[config] = true
+		logEvent("backup_created", map[string]any{"config": config, "backup": backup})
+		return nil
+	}
+}
+
+// rotateBackups thins out the config's timestamped backups to the latest one
+// of each day, for the keepDays most recent days that have backups. The most
+// recent backup is always kept. It returns the removed files.
+func rotateBackups(config string, keepDays int) ([]string, error) {
+	base := backupBase(config)
+	paths, err := filepath.Glob(base + ".*.bak")
 	if err != nil {
-		log.Fatalf("cannot get home dir: %v", err)
+		return nil, err
 	}
-	return filepath.Join(home, ".ssh", "config")
+
+	type backup struct {
+		path string
+		at   time.Time
+	}
+	var backups []backup
+	for _, p := range paths {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(p, base+"."), ".bak")
+		if i := strings.LastIndexByte(stamp, '-'); i > len("20060102") {
+			stamp = stamp[:i] // counter for a second backup in the same second
+		}
+		at, err := time.ParseInLocation("20060102-150405", stamp, time.Local)
+		if err != nil {
+			continue // not one of ours
+		}
+		backups = append(backups, backup{p, at})
+	}
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+
+	var removed []string
+	days := map[string]bool{}
+	for _, b := range backups {
+		day := b.at.Format("20060102")
+		if !days[day] && len(days) < keepDays {
+			days[day] = true
+			continue
+		}
+		if err := os.Remove(b.path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, b.path)
+	}
+	return removed, nil
+}
+
+// setDirective sets key to value inside block b. The first existing line for
+// key is rewritten in place, keeping its spelling and indentation (repeats are
+// dropped); otherwise a new line is inserted after the block's last directive.
+func setDirective(lines []string, b hostBlock, key, value string) []string {
+	ind := blockIndent(lines, b)
+	if ind == "" {
+		ind = indent
+	}
+
+	out := append([]string{}, lines[:b.Start+1]...)
+	insertAt := len(out)
+	replaced := false
+	for _, l := range lines[b.Start+1 : b.End] {
+		k, _, ok := parseDirective(l)
+		if ok && strings.EqualFold(k, key) {
+			if replaced {
+				continue
+			}
+			ws := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+			l, replaced = fmt.Sprintf("%s%s %s", ws, k, configValue(k, value)), true
+		}
+		out = append(out, l)
+		if ok {
+			insertAt = len(out)
+		}
+	}
+	if !replaced {
+		line := fmt.Sprintf("%s%s %s", ind, key, configValue(key, value))
+		out = append(out[:insertAt], append([]string{line}, out[insertAt:]...)...)
+	}
+	return append(out, lines[b.End:]...)
+}
+
+// unsetDirective removes every line for key inside block b.
+func unsetDirective(lines []string, b hostBlock, key string) []string {
+	out := append([]string{}, lines[:b.Start+1]...)
+	for _, l := range lines[b.Start+1 : b.End] {
+		if k, _, ok := parseDirective(l); ok && strings.EqualFold(k, key) {
+			continue
+		}
+		out = append(out, l)
+	}
+	return append(out, lines[b.End:]...)
 }
 
 func removeExistingAlias(config, alias string) error {
@@ -80,87 +488,308 @@ func removeExistingAlias(config, alias string) error {
 	}
 
 	lines := strings.Split(string(data), "\n")
+	begin, end, region := managedRegion(lines)
 	var out []string
-	skip := false
-	hostRe := regexp.MustCompile(`(?i)^host\\s+`)
-	for _, line := range lines {
-		if hostRe.MatchString(line) {
-			fields := strings.Fields(line)
-			hit := false
-			for _, f := range fields[1:] {
-				if f == alias {
-					hit = true
-				}
-			}
-			skip = hit
-		}
-		if !skip {
-			out = append(out, line)
+	next := 0
+	for _, b := range parseBlocks(lines) {
+		if b.hasAlias(alias) && (!region || b.inRegion(begin, end)) {
+			out = append(out, lines[next:b.Start]...)
+			next = b.End
 		}
 	}
+	out = append(out, lines[next:]...)
 
-	backup := fmt.Sprintf("%s.%s.bak", config, time.Now().Format("20060102-150405"))
-	if err := os.WriteFile(backup, data, 0600); err != nil {
+	if err := backupConfig(config, data); err != nil {
 		return err
 	}
 
-	return os.WriteFile(config, []byte(strings.Join(out, "\n")), 0600)
+	if err := writeFileAtomic(config, []byte(strings.Join(out, "\n"))); err != nil {
+		return err
+	}
+	logEvent("block_removed", map[string]any{"config": config, "host": alias})
+	return nil
+}
+
+// formatBlock renders the Host block for the current fields.
+func formatBlock() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host %s\n", alias)
+	if knownFile != "" {
+		fmt.Fprintf(&b, "%s# known-hosts: %s\n", indent, knownFile)
+	}
+	if become != "" {
+		fmt.Fprintf(&b, "%s# become: %s\n", indent, become)
+	}
+	fmt.Fprintf(&b, "%sHostName %s\n", indent, configValue("HostName", hostname))
+	fmt.Fprintf(&b, "%sUser %s\n", indent, configValue("User", username))
+	if port != "" && (port != "22" || alwaysPort) {
+		fmt.Fprintf(&b, "%sPort %s\n", indent, port)
+	}
+	if useAgent {
+		fmt.Fprintf(&b, "%sIdentitiesOnly no\n", indent)
+	} else if idfile != "" {
+		fmt.Fprintf(&b, "%sIdentityFile %s\n", indent, configValue("IdentityFile", idfile))
+	}
+	if identityAgent != "" {
+		fmt.Fprintf(&b, "%sIdentityAgent %s\n", indent, configValue("IdentityAgent", identityAgent))
+	}
+	if proxyjump != "" {
+		fmt.Fprintf(&b, "%sProxyJump %s\n", indent, configValue("ProxyJump", proxyjump))
+	}
+	for _, d := range extras {
+		fmt.Fprintf(&b, "%s%s %s\n", indent, d.Key, configValue(d.Key, d.Value))
+	}
+	return b.String()
+}
+
+// validateBlock asks ssh to parse a config holding only the new block and
+// returns ssh's complaint if it rejects it.
+func validateBlock() error {
+	f, err := os.CreateTemp("", "ssh-add-host-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(formatBlock()); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	out, err := exec.Command("ssh", "-G", "-F", f.Name(), alias).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(strings.ReplaceAll(string(out), f.Name(), "block"))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return errors.New(msg)
+	}
+	return nil
 }
 
+// appendBlock writes the block for the current fields to config: at the
+// end of the file, or of its managed region. It refuses a block without an
+// alias, HostName or User, whatever the caller checked before.
 func appendBlock(config string) error {
-	f, err := os.OpenFile(config, os.O_APPEND|os.O_WRONLY, 0600)
+	for _, f := range []struct{ name, value string }{{"Host alias", alias}, {"HostName", hostname}, {"User", username}} {
+		if strings.TrimSpace(f.value) == "" {
+			return fmt.Errorf("refusing to write Host block with an empty %s", f.name)
+		}
+	}
+	data, err := os.ReadFile(config)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	lines := strings.Split(string(data), "\n")
+	begin, end, region := managedRegion(lines)
+	if !region && !managed {
+		f, err := os.OpenFile(config, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
 
-	w := bufio.NewWriter(f)
-	fmt.Fprintln(w, "")
-	fmt.Fprintf(w, "Host %s\n", alias)
-	fmt.Fprintf(w, "    HostName %s\n", hostname)
-	fmt.Fprintf(w, "    User %s\n", username)
-	if port != "" && port != "22" {
-		fmt.Fprintf(w, "    Port %s\n", port)
+		w := bufio.NewWriter(f)
+		fmt.Fprintln(w, "")
+		fmt.Fprint(w, formatBlock())
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		logEvent("block_appended", map[string]any{"config": config, "host": alias, "hostname": hostname})
+		return nil
 	}
-	if idfile != "" {
-		fmt.Fprintf(w, "    IdentityFile %s\n", idfile)
+
+	// Managed hosts go at the end of the region, which is created at the
+	// end of the file the first time.
+	block := strings.TrimSuffix(formatBlock(), "\n")
+	var out []string
+	if region && sortedRegion {
+		var ok bool
+		if out, ok = insertSorted(lines, begin, end, block); !ok {
+			fmt.Fprintln(os.Stderr, "Warning: the managed region holds more than Host blocks; appending without sorting.")
+		}
 	}
-	if proxyjump != "" {
-		fmt.Fprintf(w, "    ProxyJump %s\n", proxyjump)
+	switch {
+	case out != nil:
+	case region:
+		out = append(out, lines[:end]...)
+		if end > begin+1 && strings.TrimSpace(lines[end-1]) != "" {
+			out = append(out, "")
+		}
+		out = append(out, block)
+		out = append(out, lines[end:]...)
+	default:
+		text := strings.TrimRight(string(data), "\n")
+		if text != "" {
+			text += "\n\n"
+		}
+		out = []string{text + managedBegin, block, managedEnd, ""}
 	}
-	if err := w.Flush(); err != nil {
+	if err := writeFileAtomic(config, []byte(strings.Join(out, "\n"))); err != nil {
 		return err
 	}
+	logEvent("block_appended", map[string]any{"config": config, "host": alias, "hostname": hostname, "managed": true})
 	return nil
 }
 
-func addKnownHosts(hostname, port string) {
-	args := []string{"-T", "5"}
-	if port != "" && port != "22" {
-		args = append(args, "-p", port)
+// insertSorted returns lines with block added to the managed region between
+// begin and end, and the region's Host blocks sorted by alias. Lines
+// outside the region are kept as they are. It fails if the region holds
+// more than Host blocks (a Match section, say), which sorting would move.
+func insertSorted(lines []string, begin, end int, block string) ([]string, bool) {
+	type chunk struct{ alias, text string }
+	chunks := []chunk{{alias, block}}
+	first, covered := end, 0
+	for _, b := range parseBlocks(lines) {
+		if !b.inRegion(begin, end) {
+			continue
+		}
+		if first == end {
+			first = b.Start
+		}
+		covered += b.End - b.Start
+		name := ""
+		if len(b.Patterns) > 0 {
+			name = b.Patterns[0]
+		}
+		chunks = append(chunks, chunk{name, strings.TrimRight(strings.Join(lines[b.Start:b.End], "\n"), "\n\t ")})
 	}
-	args = append(args, hostname)
+	if covered != end-first {
+		return nil, false
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].alias < chunks[j].alias })
 
-	cmd := exec.Command("ssh-keyscan", args...)
-	out, err := cmd.Output()
+	out := append([]string{}, lines[:first]...)
+	for i, c := range chunks {
+		if i > 0 {
+			out = append(out, "")
+		}
+		out = append(out, strings.Split(c.text, "\n")...)
+	}
+	return append(out, lines[end:]...), true
+}
+
+// handWritten reports whether alias's block in file lies outside the
+// managed region while the file has one, or --managed asks for one. Such a
+// block is the user's, and is neither overwritten nor removed.
+func handWritten(file, alias string) bool {
+	data, _ := os.ReadFile(file)
+	lines := strings.Split(string(data), "\n")
+	b, ok := findBlock(lines, alias)
+	return ok && unmanagedBlock(lines, b)
+}
+
+// unmanagedBlock is handWritten for a block of lines already read.
+func unmanagedBlock(lines []string, b hostBlock) bool {
+	begin, end, region := managedRegion(lines)
+	if !region {
+		return managed
+	}
+	return !b.inRegion(begin, end)
+}
+
+// errHandWritten is returned for edits to a block outside the managed
+// region.
+var errHandWritten = errors.New("is outside the managed region; edit it by hand")
+
+// hashKnownHosts reports whether the config enables HashKnownHosts for alias.
+func hashKnownHosts(config, alias string) bool {
+	lines, err := readConfigLines(config)
 	if err != nil {
-		return
+		return false
+	}
+	v := lookup(resolveLines(lines, alias), "HashKnownHosts")
+	return strings.EqualFold(v, "yes")
+}
+
+// runScanOnly prints the keys ssh-keyscan finds for a host without touching
+// known_hosts or the config.
+func runScanOnly() {
+	prompt(&hostname, "HostName (DNS or IP)", "")
+	prompt(&port, "Port", "22")
+	if hostname == "" {
+		log.Fatal("missing hostname")
+	}
+
+	keys, err := scanKeys(hostname, port, false)
+	if err != nil {
+		log.Fatalf("ssh-keyscan %s: %v", hostname, err)
+	}
+	if len(keys) == 0 {
+		log.Fatalf("ssh-keyscan found no keys for %s", hostname)
+	}
+	fmt.Printf("Keys that would be added to known_hosts for %s:\n", hostname)
+	for _, k := range keys {
+		keyType, fp, err := fingerprint(k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("  %s %s\n", fp, keyType)
+	}
+	fmt.Println()
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+}
+
+// addKnownHosts scans the keys of alias, just written to config, into
+// known, or into the default known_hosts file if known is empty. Hosts
+// behind a ProxyJump are scanned by connecting through the jump; others
+// with ssh-keyscan. Only keys accepted by trustKeys are added; the returned
+// error reports a failed verification.
+func addKnownHosts(config, alias, hostname, port string, hash bool, known string) error {
+	var keys []string
+	var err error
+	method := "ssh-keyscan"
+	jump := proxyjump
+	if jump == "" {
+		opts, _ := resolveHost(config, alias)
+		jump = lookup(opts, "ProxyJump")
+	}
+	if jump != "" && !strings.EqualFold(jump, "none") {
+		method = "proxyjump"
+		keys, err = scanThroughJump(config, alias)
+	} else {
+		keys, err = scanWithRetry(hostname, port, hash)
+	}
+	result := map[string]any{"hostname": hostname, "port": port, "keys": len(keys), "method": method}
+	if err == nil {
+		keys, err = trustKeys(hostname, keys)
+		result["trusted"] = len(keys)
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	logEvent("keyscan", result)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if known == "" {
+		known = knownHostsPath()
+	} else {
+		known = sshPath(known)
+	}
+	os.MkdirAll(filepath.Dir(known), 0700)
+	if keepKnownOrder {
+		return appendKnownHosts(known, keys)
 	}
 
-	home, _ := os.UserHomeDir()
-	known := filepath.Join(home, ".ssh", "known_hosts")
 	f, err := os.OpenFile(known, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
 	if err != nil {
-		return
+		return nil
 	}
 	defer f.Close()
 
-	f.Write(out)
+	f.WriteString(strings.Join(keys, "\n") + "\n")
 
 	// deduplicate
 	data, err := os.ReadFile(known)
 	if err != nil {
-		return
+		return nil
 	}
 	lines := strings.Split(string(data), "\n")
 	uniq := map[string]bool{}
@@ -175,33 +804,578 @@ func addKnownHosts(hostname, port string) {
 		}
 	}
 	sort.Strings(outLines)
-	os.WriteFile(known, []byte(strings.Join(outLines, "\n")), 0600)
+	if err := writeFileAtomic(known, []byte(strings.Join(outLines, "\n")+"\n")); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot update %s: %v\n", known, err)
+	}
+	return nil
+}
+
+// updateDefaults applies directives to the Host * block, creating the block
+// at the top of the config if it does not exist yet.
+func updateDefaults(config string, directives []directive) error {
+	return rewriteConfig(config, func(lines []string) ([]string, error) {
+		if _, ok := defaultsBlock(lines); !ok {
+			lines = insertDefaultsBlock(lines)
+		}
+		for _, d := range directives {
+			b, _ := defaultsBlock(lines)
+			lines = setDirective(lines, b, d.Key, d.Value)
+		}
+		return lines, nil
+	})
 }
 
-func main() {
-	flag.BoolVar(&force, "f", false, "force overwrite")
-	flag.StringVar(&alias, "a", "", "alias")
-	flag.StringVar(&hostname, "h", "", "hostname")
-	flag.StringVar(&username, "u", "", "user")
-	flag.StringVar(&port, "p", "", "port")
-	flag.StringVar(&idfile, "i", "", "identity file")
-	flag.StringVar(&proxyjump, "P", "", "proxyjump")
-	flag.StringVar(&addKnown, "add-known-hosts", "", "add known hosts")
-	flag.Usage = usage
-	flag.Parse()
+// defaultsBlock finds the config's first plain Host * block. A block like
+// Host * !bastion also lists * but does not apply to every host.
+func defaultsBlock(lines []string) (hostBlock, bool) {
+	for _, b := range parseBlocks(lines) {
+		if slices.Equal(b.Patterns, []string{"*"}) {
+			return b, true
+		}
+	}
+	return hostBlock{}, false
+}
+
+// insertDefaultsBlock adds an empty Host * block after the config's leading
+// top-level Include lines, so they stay outside it and keep applying to
+// every host.
+func insertDefaultsBlock(lines []string) []string {
+	at := 0
+	for i, line := range lines {
+		k, _, ok := parseDirective(line)
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(k, "host") || strings.EqualFold(k, "match") {
+			break
+		}
+		if strings.EqualFold(k, "include") {
+			at = i + 1
+		}
+	}
+	block := []string{"Host *"}
+	if at > 0 {
+		block = append([]string{""}, block...)
+	}
+	if at == len(lines) || strings.TrimSpace(lines[at]) != "" {
+		block = append(block, "")
+	}
+	out := append([]string{}, lines[:at]...)
+	out = append(out, block...)
+	return append(out, lines[at:]...)
+}
+
+// rewriteConfig passes the config's lines through edit and, if edit
+// succeeds, backs up the old contents and writes the result.
+func rewriteConfig(config string, edit func(lines []string) ([]string, error)) error {
+	data, err := os.ReadFile(config)
+	if err != nil {
+		return err
+	}
+
+	lines, err := edit(strings.Split(string(data), "\n"))
+	if err != nil {
+		return err
+	}
+
+	if err := backupConfig(config, data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(config, []byte(strings.Join(lines, "\n"))); err != nil {
+		return err
+	}
+	logEvent("config_rewritten", map[string]any{"config": config})
+	return nil
+}
+
+// runSet handles --set alias Key Value and --unset alias Key, changing a
+// single directive of an existing block and leaving everything else as is.
+// The block is edited in whichever of the config and its included files
+// defines it, so hosts added with --into can be changed too.
+func runSet(unset bool, args []string) {
+	want := 3
+	if unset {
+		want = 2
+	}
+	if len(args) != want {
+		addUsage()
+		os.Exit(2)
+	}
+	alias, key := args[0], args[1]
+	switch strings.ToLower(key) {
+	case "host", "match", "include":
+		log.Fatalf("%s is not a host directive and cannot be changed with --set or --unset", key)
+	}
+	if !unset {
+		checkDirectives([]directive{{key, args[2]}})
+	}
+
+	config := sshConfigPath()
+	var file string
+	for _, f := range configFiles(config, config) {
+		data, _ := os.ReadFile(f)
+		if _, ok := findBlock(strings.Split(string(data), "\n"), alias); ok {
+			file = f
+			break
+		}
+	}
+	if file == "" {
+		log.Fatalf("host %q not found in %s", alias, config)
+	}
+
+	err := rewriteConfig(file, func(lines []string) ([]string, error) {
+		b, _ := findBlock(lines, alias)
+		if unmanagedBlock(lines, b) {
+			return nil, fmt.Errorf("host %q in %s %w", alias, file, errHandWritten)
+		}
+		if unset {
+			return unsetDirective(lines, b, key), nil
+		}
+		return setDirective(lines, b, key, args[2]), nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if unset {
+		fmt.Printf("Removed %s from Host \"%s\" in %s.\n", key, alias, file)
+	} else {
+		fmt.Printf("Set %s %s for Host \"%s\" in %s.\n", key, args[2], alias, file)
+	}
+}
+
+// disableBlock comments out every line of block b, leaving its trailing
+// blank lines alone.
+func disableBlock(lines []string, b hostBlock) []string {
+	end := b.End
+	for end > b.Start+1 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	out := append([]string{}, lines[:b.Start]...)
+	for _, l := range lines[b.Start:end] {
+		out = append(out, strings.TrimRight("# "+l, " "))
+	}
+	return append(out, lines[end:]...)
+}
+
+// enableBlock reverses disableBlock for a block found by findDisabledBlock.
+func enableBlock(lines []string, b hostBlock) []string {
+	out := append([]string{}, lines...)
+	for i := b.Start; i < b.End; i++ {
+		out[i], _ = uncomment(lines[i])
+	}
+	return out
+}
+
+// runToggle handles --disable alias and --enable alias, commenting a host's
+// block out or back in. The block stays in the file, but ssh and listHosts
+// ignore it while it is disabled.
+func runToggle(enable bool, args []string) {
+	if len(args) != 1 {
+		addUsage()
+		os.Exit(2)
+	}
+	alias := args[0]
+
+	config := sshConfigPath()
+	var file string
+	for _, f := range configFiles(config, config) {
+		data, _ := os.ReadFile(f)
+		lines := strings.Split(string(data), "\n")
+		if _, ok := findBlock(lines, alias); ok && !enable {
+			file = f
+			break
+		}
+		if _, ok := findDisabledBlock(lines, alias); ok && enable {
+			file = f
+			break
+		}
+	}
+	if file == "" {
+		state := "enabled"
+		if enable {
+			state = "disabled"
+		}
+		fmt.Fprintf(os.Stderr, "No %s Host \"%s\" found in %s.\n", state, alias, config)
+		os.Exit(1)
+	}
+
+	err := rewriteConfig(file, func(lines []string) ([]string, error) {
+		find, toggle := findBlock, disableBlock
+		if enable {
+			find, toggle = findDisabledBlock, enableBlock
+		}
+		b, _ := find(lines, alias)
+		if unmanagedBlock(lines, b) {
+			return nil, fmt.Errorf("host %q in %s %w", alias, file, errHandWritten)
+		}
+		return toggle(lines, b), nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if enable {
+		fmt.Printf("Enabled Host \"%s\" in %s.\n", alias, file)
+	} else {
+		fmt.Printf("Disabled Host \"%s\" in %s.\n", alias, file)
+	}
+}
+
+// includeCovers reports whether a top-level Include line (one before any Host
+// or Match) has a pattern matching target.
+func includeCovers(lines []string, target string) bool {
+	for _, line := range lines {
+		k, v, ok := parseDirective(line)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(k) {
+		case "host", "match":
+			return false
+		case "include":
+			for _, pat := range strings.Fields(v) {
+				if ok, _ := filepath.Match(sshPath(pat), target); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ensureInclude adds "Include file" at the top of the config unless an
+// existing Include already covers it. It reports whether a line was added.
+func ensureInclude(config, file string) (bool, error) {
+	data, err := os.ReadFile(config)
+	if err != nil {
+		return false, err
+	}
+	if includeCovers(strings.Split(string(data), "\n"), sshPath(file)) {
+		return false, nil
+	}
+	err = rewriteConfig(config, func(lines []string) ([]string, error) {
+		return append([]string{"Include " + file, ""}, lines...), nil
+	})
+	return err == nil, err
+}
+
+// configFiles lists the files that may define a host: the file being
+// written, the main config and the files it includes.
+func configFiles(target, config string) []string {
+	var files []string
+	seen := map[string]bool{}
+	for _, f := range append([]string{target, config}, includedFiles(config)...) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// findOwners returns the files whose blocks list alias, along with the
+// lines of the first such file and the block in it.
+func findOwners(files []string, alias string) (owners, lines []string, first hostBlock) {
+	for _, f := range files {
+		data, _ := os.ReadFile(f)
+		fileLines := strings.Split(string(data), "\n")
+		existing, ok := findBlock(fileLines, alias)
+		if !ok {
+			continue
+		}
+		if len(owners) == 0 {
+			lines, first = fileLines, existing
+		}
+		owners = append(owners, f)
+	}
+	return owners, lines, first
+}
+
+// aliasClash returns the first of files in which hostname, the HostName
+// for alias, is itself a Host alias, or "" if it is none. ssh would connect
+// to that name as a DNS host rather than follow the alias.
+func aliasClash(files []string, alias, hostname string) string {
+	if hostname == alias {
+		return ""
+	}
+	if owners, _, _ := findOwners(files, hostname); len(owners) > 0 {
+		return owners[0]
+	}
+	return ""
+}
+
+// modTimes records the modification time of each file; missing files get
+// the zero time.
+func modTimes(files []string) map[string]time.Time {
+	stamps := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			stamps[f] = fi.ModTime()
+		} else {
+			stamps[f] = time.Time{}
+		}
+	}
+	return stamps
+}
+
+// changedSince returns the files whose modification time differs from the
+// recorded one.
+func changedSince(stamps map[string]time.Time) []string {
+	var changed []string
+	for f, t := range stamps {
+		var now time.Time
+		if fi, err := os.Stat(f); err == nil {
+			now = fi.ModTime()
+		}
+		if !now.Equal(t) {
+			changed = append(changed, f)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// ensureConfig returns the config path, creating an empty config (and its
+// directory, with mode 0700) if there is none yet.
+func ensureConfig() string {
+	config := sshConfigPath()
+	if _, err := os.Stat(config); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(config), 0700); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(config, []byte{}, 0600); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return config
+}
+
+// addDefaults are the tool defaults, loaded once by addMain.
+var addDefaults toolDefaults
+
+// checkDirectives exits if the tool defaults forbid writing any of ds.
+func checkDirectives(ds []directive) {
+	for _, d := range ds {
+		if err := addDefaults.check(d); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func runDefaults() {
+	agent := ""
+	if addKeysToAgent {
+		agent = "yes"
+	}
+	if serverAliveInterval == "" && agent == "" {
+		prompt(&serverAliveInterval, "ServerAliveInterval in seconds (optional, blank to skip)", "")
+		prompt(&agent, "AddKeysToAgent yes/no (optional, blank to skip)", "")
+	}
+
+	var directives []directive
+	if serverAliveInterval != "" {
+		if n, err := strconv.Atoi(serverAliveInterval); err != nil || n < 0 {
+			log.Fatal("server alive interval must be a non-negative number")
+		}
+		directives = append(directives, directive{"ServerAliveInterval", serverAliveInterval})
+	}
+	if agent != "" {
+		agent = strings.ToLower(agent)
+		if agent != "yes" && agent != "no" {
+			log.Fatal("AddKeysToAgent must be yes or no")
+		}
+		directives = append(directives, directive{"AddKeysToAgent", agent})
+	}
+	if len(directives) == 0 {
+		log.Fatal("no defaults given")
+	}
+	checkDirectives(directives)
+
+	config := ensureConfig()
+	if !assumeYes && !force && !nonInteractive {
+		fmt.Println("\nHost *")
+		for _, d := range directives {
+			fmt.Printf("%s%s %s\n", indent, d.Key, d.Value)
+		}
+		fmt.Println()
+		if !confirm(fmt.Sprintf("Write these defaults to %s?", config)) {
+			fmt.Fprintln(os.Stderr, "Aborted.")
+			os.Exit(1)
+		}
+	}
+
+	if err := updateDefaults(config, directives); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Updated Host * defaults in %s.\n", config)
+}
+
+func addMain(args []string) {
+	fs := flag.NewFlagSet(prog, flag.ExitOnError)
+	fs.BoolVar(&force, "f", false, "force overwrite")
+	fs.BoolVar(&assumeYes, "y", false, "skip confirmation")
+	fs.BoolVar(&nonInteractive, "non-interactive", false, "never prompt")
+	fs.StringVar(&alias, "a", "", "alias")
+	fs.StringVar(&hostname, "h", "", "hostname")
+	fs.StringVar(&username, "u", "", "user")
+	fs.StringVar(&port, "p", "", "port")
+	fs.StringVar(&idfile, "i", "", "identity file")
+	fs.StringVar(&proxyjump, "P", "", "proxyjump")
+	fs.StringVar(&addKnown, "add-known-hosts", "", "add known hosts")
+	fs.StringVar(&indentFlag, "indent", "", "indentation")
+	fs.Var(&extras, "o", "extra directive Key=Value")
+	fs.BoolVar(&validate, "validate", false, "validate with ssh -G")
+	fs.BoolVar(&defaultsMode, "defaults", false, "edit Host * defaults")
+	fs.StringVar(&serverAliveInterval, "server-alive-interval", "", "ServerAliveInterval")
+	fs.BoolVar(&addKeysToAgent, "add-keys-to-agent", false, "AddKeysToAgent yes")
+	fs.BoolVar(&setMode, "set", false, "set one directive")
+	fs.BoolVar(&unsetMode, "unset", false, "remove one directive")
+	fs.StringVar(&identityAgent, "identity-agent", "", "IdentityAgent socket")
+	fs.BoolVar(&alwaysPort, "always-write-port", false, "write Port even when it is 22")
+	fs.BoolVar(&managed, "managed", false, "write hosts inside the managed region")
+	fs.BoolVar(&sortedRegion, "sorted-region", false, "keep the managed region sorted by alias")
+	fs.StringVar(&presetName, "preset", "", "pre-fill the fields for a common kind of host")
+	fs.BoolVar(&listPresetsMode, "list-presets", false, "list the built-in presets")
+	fs.BoolVar(&verifyKeys, "verify-keys", false, "confirm each scanned key")
+	fs.Var(&expectedKeys, "expect-fingerprint", "only trust keys with this fingerprint (repeatable)")
+	fs.BoolVar(&logJSON, "log-json", false, "log changes as JSON lines")
+	fs.BoolVar(&disableMode, "disable", false, "comment out a host")
+	fs.BoolVar(&enableMode, "enable", false, "uncomment a disabled host")
+	fs.BoolVar(&rotateMode, "rotate-backups", false, "rotate config backups")
+	fs.StringVar(&importFile, "import", "", "add the hosts of a CSV or JSON file")
+	fs.StringVar(&importFmt, "import-format", "", "csv or json (default: by extension)")
+	fs.BoolVar(&summaryJSON, "summary-json", false, "print the --import summary as JSON")
+	fs.StringVar(&backupDir, "backup-dir", "", "directory for config backups")
+	fs.IntVar(&keepDays, "keep-days", 7, "days of backups to keep")
+	fs.StringVar(&into, "into", "", "write to an Include file")
+	fs.BoolVar(&keepKnownOrder, "no-touch-known-hosts-order", false, "append-only known_hosts")
+	fs.StringVar(&knownFile, "known-hosts", "", "known_hosts file for this host")
+	fs.StringVar(&become, "become", "", "escalation command for ssh-menu --become")
+	fs.BoolVar(&useAgent, "use-agent", false, "rely on ssh-agent keys")
+	fs.BoolVar(&scanOnly, "scan-only", false, "only show scanned host keys")
+	fs.Usage = addUsage
+	fs.Parse(args)
+	if sortedRegion {
+		managed = true
+	}
+
+	var err error
+	if addDefaults, err = loadDefaults(); err != nil {
+		log.Fatal(err)
+	}
+	checkDirectives(extras)
+	if err := checkBecome(become); err != nil {
+		log.Fatal(err)
+	}
+
+	if indentFlag != "" {
+		if indent, err = parseIndent(indentFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch {
+	case defaultsMode:
+		runDefaults()
+		return
+	case setMode || unsetMode:
+		runSet(unsetMode, fs.Args())
+		return
+	case disableMode || enableMode:
+		runToggle(enableMode, fs.Args())
+		return
+	case scanOnly:
+		runScanOnly()
+		return
+	case listPresetsMode:
+		listPresets()
+		return
+	case importFile != "":
+		runImport(importFile, importFmt, summaryJSON)
+		return
+	case rotateMode:
+		if keepDays < 1 {
+			log.Fatal("--keep-days must be at least 1")
+		}
+		removed, err := rotateBackups(sshConfigPath(), keepDays)
+		for _, p := range removed {
+			fmt.Printf("Removed %s\n", p)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Removed %d old backup(s).\n", len(removed))
+		return
+	}
+
+	if useAgent && idfile != "" {
+		log.Fatal("--use-agent and -i are mutually exclusive")
+	}
+
+	// Positional alias, hostname and user fill in whatever the flags left
+	// unset; explicit flags win.
+	if fs.NArg() > 3 {
+		addUsage()
+		os.Exit(2)
+	}
+	for i, field := range []*string{&alias, &hostname, &username}[:fs.NArg()] {
+		if *field == "" {
+			*field = fs.Arg(i)
+		}
+	}
+
+	// A preset only changes the prompt defaults, so flags and answers win.
+	pre := preset{User: os.Getenv("USER"), Port: "22"}
+	if presetName != "" {
+		p, err := findPreset(presetName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if p.User == "" {
+			p.User = pre.User
+		}
+		if p.Port == "" {
+			p.Port = pre.Port
+		}
+		pre = p
+	}
 
 	prompt(&alias, "Host alias (unique, no spaces)", "")
-	prompt(&hostname, "HostName (DNS or IP)", "")
-	prompt(&username, "User", os.Getenv("USER"))
-	prompt(&port, "Port", "22")
-	prompt(&idfile, "IdentityFile path (optional, blank to skip)", "")
+	prompt(&hostname, "HostName (DNS or IP)", pre.HostName)
+	prompt(&username, "User", pre.User)
+	prompt(&port, "Port", pre.Port)
+	if !useAgent {
+		prompt(&idfile, "IdentityFile path (optional, blank to skip)", pre.IdentityFile)
+	}
 	prompt(&proxyjump, "ProxyJump (optional, blank to skip)", "")
 	prompt(&addKnown, "Add to known_hosts via ssh-keyscan? yes/no", addKnown)
+	applyPresetExtras(pre)
 
 	if alias == "" || hostname == "" || username == "" || port == "" {
 		log.Fatal("missing required fields")
 	}
 
+	if err := checkUser(username); err != nil {
+		u, h, ok := splitUserHost(username)
+		split := ok && !nonInteractive && !assumeYes
+		if split {
+			msg := fmt.Sprintf("Use User %s and HostName %s", u, h)
+			if h != hostname {
+				msg += fmt.Sprintf(" (instead of %s)", hostname)
+			}
+			split = confirm(msg + "?")
+		}
+		switch {
+		case split:
+			username, hostname = u, h
+		case !force:
+			fmt.Fprintf(os.Stderr, "Refusing to write: %v. Use -f to write it anyway.\n", err)
+			os.Exit(2)
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: %v.\n", err)
+		}
+	}
+
 	port = strings.TrimSpace(port)
 	if port == "" {
 		log.Fatal("port must not be empty")
@@ -212,37 +1386,119 @@ func main() {
 		log.Fatal("port must be a number between 1 and 65535")
 	}
 
-	home, _ := os.UserHomeDir()
-	sshDir := filepath.Join(home, ".ssh")
-	os.MkdirAll(sshDir, 0700)
-	config := sshConfigPath()
-	if _, err := os.Stat(config); errors.Is(err, os.ErrNotExist) {
-		os.WriteFile(config, []byte{}, 0600)
+	if identityAgent != "" {
+		checkIdentityAgent(identityAgent)
+	}
+
+	// A preset may have added extras since they were first checked.
+	checkDirectives(extras)
+
+	config := ensureConfig()
+	target := config
+	if into != "" {
+		target = sshPath(into)
+		os.MkdirAll(filepath.Dir(target), 0700)
+		if _, err := os.Stat(target); errors.Is(err, os.ErrNotExist) {
+			os.WriteFile(target, []byte{}, 0600)
+		}
 	}
 
-	exists := false
-	data, _ := os.ReadFile(config)
-	if regexp.MustCompile(fmt.Sprintf(`(?i)^host\\s+%s(\\s|$)`, regexp.QuoteMeta(alias))).Match(data) {
-		exists = true
+	files := configFiles(target, config)
+	stamps := modTimes(files)
+	owners, prevLines, prev := findOwners(files, alias)
+	if len(owners) > 0 {
+		if ws := blockIndent(prevLines, prev); ws != "" && indentFlag == "" {
+			indent = ws
+		}
+		// Keep the tool's own comments from the block being replaced.
+		if knownFile == "" {
+			knownFile = blockComment(prevLines, prev, "known-hosts")
+		}
+		if become == "" {
+			become = blockComment(prevLines, prev, "become")
+		}
+	}
+	for _, f := range owners {
+		if handWritten(f, alias) {
+			fmt.Fprintf(os.Stderr, "Host \"%s\" in %s is outside the managed region; edit it by hand.\n", alias, f)
+			os.Exit(2)
+		}
+	}
+	if len(owners) > 0 && !force {
+		fmt.Fprintf(os.Stderr, "Host \"%s\" already exists in %s. Use -f to overwrite.\n", alias, owners[0])
+		os.Exit(2)
 	}
 
-	if exists {
+	// A HostName naming another alias makes ssh connect to that alias's
+	// name as a DNS host, which is rarely what was meant.
+	if clash := aliasClash(files, alias, hostname); clash != "" {
 		if !force {
-			fmt.Fprintf(os.Stderr, "Host \"%s\" already exists in %s. Use -f to overwrite.\n", alias, config)
+			fmt.Fprintf(os.Stderr, "HostName \"%s\" is an existing Host alias in %s; did you mean its HostName? Use -f to write it anyway.\n", hostname, clash)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: HostName \"%s\" is an existing Host alias.\n", hostname)
+	}
+
+	if validate {
+		if err := validateBlock(); err != nil {
+			if !force {
+				fmt.Fprintf(os.Stderr, "ssh rejected the block:\n%s\nFix it or use -f to write anyway.\n", err)
+				os.Exit(2)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: ssh rejected the block:\n%s\n", err)
+		}
+	}
+
+	if !assumeYes && !force && !nonInteractive {
+		fmt.Printf("\n%s\n", formatBlock())
+		if !confirm(fmt.Sprintf("Write this to %s?", target)) {
+			fmt.Fprintln(os.Stderr, "Aborted.")
+			os.Exit(1)
+		}
+	}
+
+	// Another process may have edited the config while we were prompting;
+	// check again so we neither clobber nor duplicate its change.
+	if changed := changedSince(stamps); len(changed) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s changed since it was read; re-checking.\n", strings.Join(changed, ", "))
+		owners, _, _ = findOwners(configFiles(target, config), alias)
+		if len(owners) > 0 && !force {
+			fmt.Fprintf(os.Stderr, "Host \"%s\" now exists in %s. Use -f to overwrite.\n", alias, owners[0])
 			os.Exit(2)
 		}
-		if err := removeExistingAlias(config, alias); err != nil {
+	}
+
+	for _, f := range owners {
+		if err := removeExistingAlias(f, alias); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	if err := appendBlock(config); err != nil {
+	if into != "" {
+		added, err := ensureInclude(config, into)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if added {
+			fmt.Printf("Added \"Include %s\" to %s.\n", into, config)
+		}
+	}
+
+	if err := appendBlock(target); err != nil {
 		log.Fatal(err)
 	}
 
+	var keyErr error
 	if strings.ToLower(addKnown) == "yes" {
-		addKnownHosts(hostname, port)
+		keyErr = addKnownHosts(config, alias, hostname, port, hashKnownHosts(config, alias), knownFile)
 	}
 
-	fmt.Printf("Added Host \"%s\" to %s.\n", alias, config)
-}
\ No newline at end of file
+	fmt.Printf("Added Host \"%s\" to %s.\n", alias, target)
+	switch {
+	case errors.Is(keyErr, errUntrusted):
+		fmt.Fprintf(os.Stderr, "known_hosts not changed: %v\n", keyErr)
+		os.Exit(1)
+	case keyErr != nil:
+		fmt.Fprintf(os.Stderr, "Warning: cannot add host keys: %v\n", keyErr)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a test fixture, failing the test on error.
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFile returns a file's contents, failing the test on error.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUpdateDefaultsKeepsLeadingIncludes(t *testing.T) {
+	dir := t.TempDir()
+	confd := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confd, 0700); err != nil {
+		t.Fatal(err)
+	}
+	web := filepath.Join(confd, "web.conf")
+	writeFile(t, web, "Host web\n    HostName 10.0.0.1\n")
+	include := "Include " + confd + "/*.conf"
+
+	tests := []struct {
+		name, config, want string
+	}{
+		{
+			name:   "include then blank line",
+			config: include + "\n\nHost db\n    HostName 10.0.0.2\n",
+			want:   include + "\n\nHost *\n    ServerAliveInterval 60\n\nHost db\n    HostName 10.0.0.2\n",
+		},
+		{
+			name:   "include directly before a host",
+			config: include + "\nHost db\n    HostName 10.0.0.2\n",
+			want:   include + "\n\nHost *\n    ServerAliveInterval 60\n\nHost db\n    HostName 10.0.0.2\n",
+		},
+		{
+			name:   "only an include",
+			config: include,
+			want:   include + "\n\nHost *\n    ServerAliveInterval 60\n",
+		},
+		{
+			name:   "no include",
+			config: "Host db\n    HostName 10.0.0.2\n",
+			want:   "Host *\n    ServerAliveInterval 60\n\nHost db\n    HostName 10.0.0.2\n",
+		},
+		{
+			name:   "negated defaults block",
+			config: "Host * !bastion\n    ProxyJump bastion\n",
+			want:   "Host *\n    ServerAliveInterval 60\n\nHost * !bastion\n    ProxyJump bastion\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), "config")
+			writeFile(t, config, tt.config)
+			if err := updateDefaults(config, []directive{{Key: "ServerAliveInterval", Value: "60"}}); err != nil {
+				t.Fatal(err)
+			}
+			got := readFile(t, config)
+			if got != tt.want {
+				t.Fatalf("config:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if !strings.Contains(tt.config, "Include") {
+				return
+			}
+			if files := includedFiles(config); !slices.Equal(files, []string{web}) {
+				t.Errorf("includedFiles = %q, want %q", files, []string{web})
+			}
+			if !includeCovers(strings.Split(got, "\n"), web) {
+				t.Errorf("Include no longer covers %s", web)
+			}
+		})
+	}
+}
+
+func TestEnsureConfigCreatesParent(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "home", ".ssh", "config")
+	useConfig(t, config)
+
+	if got := ensureConfig(); got != config {
+		t.Fatalf("ensureConfig() = %s, want %s", got, config)
+	}
+	fi, err := os.Stat(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("config: size %d, mode %v; want an empty 0600 file", fi.Size(), fi.Mode().Perm())
+	}
+	if fi, err := os.Stat(filepath.Dir(config)); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Errorf("config directory mode = %v, want 0700", fi.Mode().Perm())
+	}
+
+	// An existing config is left alone.
+	writeFile(t, config, "Host web\n")
+	ensureConfig()
+	if got := readFile(t, config); got != "Host web\n" {
+		t.Errorf("existing config became %q", got)
+	}
+}
+
+// setFields sets the host fields formatBlock writes for the rest of the
+// test.
+func setFields(t *testing.T, a, h, u string) {
+	t.Helper()
+	oldA, oldH, oldU, oldPort := alias, hostname, username, port
+	alias, hostname, username, port = a, h, u, "22"
+	t.Cleanup(func() { alias, hostname, username, port = oldA, oldH, oldU, oldPort })
+}
+
+func TestAppendBlockRefusesEmptyFields(t *testing.T) {
+	tests := []struct {
+		name, alias, hostname, user string
+	}{
+		{"empty alias", "", "10.0.0.1", "ubuntu"},
+		{"blank alias", "  ", "10.0.0.1", "ubuntu"},
+		{"empty HostName", "web", "", "ubuntu"},
+		{"blank HostName", "web", " \t", "ubuntu"},
+		{"empty User", "web", "10.0.0.1", ""},
+		{"blank User", "web", "10.0.0.1", " "},
+	}
+	const before = "Host db\n    HostName 10.0.0.2\n"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), "config")
+			writeFile(t, config, before)
+			setFields(t, tt.alias, tt.hostname, tt.user)
+
+			if err := appendBlock(config); err == nil {
+				t.Error("appendBlock returned no error")
+			}
+			if got := readFile(t, config); got != before {
+				t.Errorf("config changed to %q", got)
+			}
+		})
+	}
+
+	config := filepath.Join(t.TempDir(), "config")
+	writeFile(t, config, before)
+	setFields(t, "web", "10.0.0.1", "ubuntu")
+	if err := appendBlock(config); err != nil {
+		t.Fatalf("complete block: %v", err)
+	}
+	if want := before + "\nHost web\n    HostName 10.0.0.1\n    User ubuntu\n"; readFile(t, config) != want {
+		t.Errorf("config = %q, want %q", readFile(t, config), want)
+	}
+}
+
+func TestCheckUser(t *testing.T) {
+	tests := []struct {
+		user      string
+		valid     bool
+		splitUser string
+		splitHost string
+	}{
+		{"ubuntu", true, "", ""},
+		{"me@10.0.0.5", false, "me", "10.0.0.5"},
+		{"a b", false, "", ""},
+		{`dom\user`, true, "", ""},
+		{"@10.0.0.5", false, "", ""},
+		{"me@", false, "", ""},
+		{"a b@10.0.0.5", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			if err := checkUser(tt.user); (err == nil) != tt.valid {
+				t.Errorf("checkUser(%q) = %v, want valid %v", tt.user, err, tt.valid)
+			}
+			u, h, ok := splitUserHost(tt.user)
+			if ok != (tt.splitUser != "") || u != tt.splitUser || h != tt.splitHost {
+				t.Errorf("splitUserHost(%q) = %q, %q, %v; want %q, %q", tt.user, u, h, ok, tt.splitUser, tt.splitHost)
+			}
+		})
+	}
+}
+
+func TestAliasClash(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	included := filepath.Join(dir, "web.conf")
+	writeFile(t, config, "Host bastion jump\n    HostName 10.0.0.1\n\nHost *.internal\n    User admin\n")
+	writeFile(t, included, "Host web\n    HostName 10.0.0.2\n")
+	files := []string{config, included}
+
+	tests := []struct {
+		alias, hostname, want string
+	}{
+		{"db", "bastion", config},
+		{"db", "jump", config},
+		{"db", "web", included},
+		{"db", "10.0.0.3", ""},
+		{"db", "db.internal", ""}, // a wildcard pattern is not an alias
+		{"web", "web", ""},        // HostName may repeat the alias
+	}
+	for _, tt := range tests {
+		if got := aliasClash(files, tt.alias, tt.hostname); got != tt.want {
+			t.Errorf("aliasClash(%s, %s) = %q, want %q", tt.alias, tt.hostname, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBecome(t *testing.T) {
+	tests := []struct {
+		cmd string
+		ok  bool
+	}{
+		{"", true},
+		{"sudo -i", true},
+		{"sudo -u postgres psql # as postgres", true},
+		{"sudo -i\nrm -rf /", false},
+		{"sudo -i\r", false},
+		{" sudo -i", false},
+	}
+	for _, tt := range tests {
+		if err := checkBecome(tt.cmd); (err == nil) != tt.ok {
+			t.Errorf("checkBecome(%q) = %v, want ok %v", tt.cmd, err, tt.ok)
+		}
+	}
+}
+
+func TestRemoveKeepsDisabledBlockBelow(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	lines := strings.Split("Host a\n    HostName 10.0.0.1\n\nHost b\n    HostName 10.0.0.2\n\nHost c\n    HostName 10.0.0.3\n", "\n")
+	b, _ := findBlock(lines, "b")
+	writeFile(t, config, strings.Join(disableBlock(lines, b), "\n"))
+
+	if err := removeExistingAlias(config, "a"); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Host b\n#     HostName 10.0.0.2\n\nHost c\n    HostName 10.0.0.3\n"
+	if got := readFile(t, config); got != want {
+		t.Fatalf("after removing a:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Overwriting a host above a disabled one keeps it too.
+	writeFile(t, config, strings.Join(disableBlock(lines, b), "\n"))
+	if err := removeExistingAlias(config, "a"); err != nil {
+		t.Fatal(err)
+	}
+	setFields(t, "a", "10.0.0.9", "ubuntu")
+	if err := appendBlock(config); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(readFile(t, config), "\n")
+	if d, ok := findDisabledBlock(got, "b"); !ok || !slices.Contains(got[d.Start:d.End], "#     HostName 10.0.0.2") {
+		t.Errorf("disabled b lost after overwriting a:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestBackupConfigOncePerRun(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	defer delete(backedUp, config)
+	if err := backupConfig(config, []byte("Host a\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupConfig(config, []byte("Host a\nHost b\n")); err != nil {
+		t.Fatal(err)
+	}
+	paths, _ := filepath.Glob(config + ".*.bak")
+	if len(paths) != 1 || readFile(t, paths[0]) != "Host a\n" {
+		t.Fatalf("backups = %q, want one with the first contents", paths)
+	}
+
+	// A later run in the same second gets a new file instead of
+	// overwriting the first backup.
+	delete(backedUp, config)
+	if err := backupConfig(config, []byte("Host b\n")); err != nil {
+		t.Fatal(err)
+	}
+	paths, _ = filepath.Glob(config + ".*.bak")
+	if len(paths) != 2 {
+		t.Fatalf("backups = %q, want two", paths)
+	}
+	if readFile(t, paths[0]) != "Host a\n" && readFile(t, paths[1]) != "Host a\n" {
+		t.Errorf("first backup overwritten: %q", paths)
+	}
+
+	// Rotation reads the counter names as backups of the same day.
+	removed, err := rotateBackups(config, 1)
+	if err != nil || len(removed) != 1 {
+		t.Errorf("rotateBackups removed %q, %v; want one", removed, err)
+	}
+}
+
+func TestSetEditsIncludedFile(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	web := filepath.Join(dir, "web.conf")
+	writeFile(t, config, "Include "+web+"\n\nHost db\n    HostName 10.0.0.2\n")
+	writeFile(t, web, "Host web\n    HostName 10.0.0.1\n")
+	useConfig(t, config)
+
+	runSet(false, []string{"web", "Port", "2222"})
+	if got, want := readFile(t, web), "Host web\n    HostName 10.0.0.1\n    Port 2222\n"; got != want {
+		t.Errorf("web.conf after --set:\n%s\nwant:\n%s", got, want)
+	}
+	runSet(true, []string{"web", "Port"})
+	if got, want := readFile(t, web), "Host web\n    HostName 10.0.0.1\n"; got != want {
+		t.Errorf("web.conf after --unset:\n%s\nwant:\n%s", got, want)
+	}
+	if got := readFile(t, config); strings.Contains(got, "Port") {
+		t.Errorf("main config changed:\n%s", got)
+	}
+}
@@ -1,119 +1,992 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
 )
 
-func sshConfigPath() string {
-	if path := os.Getenv("SSH_CONFIG"); path != "" {
-		return path
+// hostNames maps each alias to the HostName ssh would connect to, falling
+// back to the alias itself.
+func hostNames(config string, hosts []string) (map[string]string, error) {
+	lines, err := readConfigLines(config)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(hosts))
+	for _, h := range hosts {
+		names[h] = h
+		if hn := lookup(resolveLines(lines, h), "HostName"); hn != "" {
+			names[h] = strings.Trim(hn, `"`)
+		}
+	}
+	return names, nil
+}
+
+// expandPath expands a leading ~ and the %d, %h, %r, %u and %% tokens that
+// ssh allows in paths such as IdentityFile.
+func expandPath(path, alias string, opts []directive) string {
+	path = strings.Trim(path, `"`)
+	home, _ := os.UserHomeDir()
+	local := os.Getenv("USER")
+	remote := lookup(opts, "User")
+	if remote == "" {
+		remote = local
+	}
+	host := lookup(opts, "HostName")
+	if host == "" {
+		host = alias
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+	return strings.NewReplacer("%%", "%", "%d", home, "%h", host, "%r", remote, "%u", local).Replace(path)
+}
+
+// identityFile is one entry of the ordered list of keys ssh tries for a
+// host.
+type identityFile struct {
+	Path     string `json:"path"`
+	Expanded string `json:"expanded"`
+	Exists   bool   `json:"exists"`
+}
+
+// identityChain returns the IdentityFile entries in the order ssh tries
+// them, combining those from every matching block.
+func identityChain(alias string, opts []directive) []identityFile {
+	var chain []identityFile
+	for _, d := range opts {
+		if !strings.EqualFold(d.Key, "IdentityFile") || strings.EqualFold(d.Value, "none") {
+			continue
+		}
+		id := identityFile{Path: d.Value, Expanded: expandPath(d.Value, alias, opts)}
+		_, err := os.Stat(id.Expanded)
+		id.Exists = err == nil
+		chain = append(chain, id)
 	}
-	home, err := os.UserHomeDir()
+	return chain
+}
+
+// describeHost prints the resolved directives for alias as a Host block, or
+// as JSON when asJSON is set, followed by the keys ssh will try.
+func describeHost(config, alias string, asJSON bool) error {
+	opts, err := resolveHost(config, alias)
 	if err != nil {
-		log.Fatalf("cannot get home dir: %v", err)
+		return err
+	}
+	chain := identityChain(alias, opts)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Host          string         `json:"host"`
+			Options       []directive    `json:"options"`
+			IdentityFiles []identityFile `json:"identity_files"`
+		}{alias, opts, chain})
+	}
+	fmt.Printf("Host %s\n", alias)
+	for _, d := range opts {
+		fmt.Printf("    %s %s\n", d.Key, d.Value)
 	}
-	return filepath.Join(home, ".ssh", "config")
+
+	fmt.Println("\nIdentityFile order:")
+	if len(chain) == 0 {
+		fmt.Println("    (none set; ssh tries its default keys)")
+	}
+	for i, id := range chain {
+		note := ""
+		if !id.Exists {
+			note = "  [missing]"
+		}
+		fmt.Printf("    %d. %s%s\n", i+1, id.Expanded, note)
+	}
+	return nil
 }
 
-func listHosts(config string) ([]string, error) {
-	f, err := os.Open(config)
+// auditKeys reports, per host, the IdentityFile keys that do not exist on
+// disk and returns how many hosts have missing keys.
+func auditKeys(config string) (int, error) {
+	hosts, err := listHosts(config)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	bad := 0
+	for _, h := range hosts {
+		opts, err := resolveHost(config, h)
+		if err != nil {
+			return bad, err
+		}
+		chain := identityChain(h, opts)
+		var missing []string
+		for _, id := range chain {
+			if !id.Exists {
+				missing = append(missing, id.Expanded)
+			}
+		}
+		switch {
+		case len(chain) == 0:
+			fmt.Printf("%s: no IdentityFile\n", h)
+		case len(missing) == 0:
+			fmt.Printf("%s: ok (%d key(s))\n", h, len(chain))
+		default:
+			bad++
+			fmt.Printf("%s: missing %s\n", h, strings.Join(missing, ", "))
+		}
+	}
+	fmt.Printf("\n%d of %d host(s) reference missing keys.\n", bad, len(hosts))
+	return bad, nil
+}
+
+// historyPath returns the file recording which hosts were connected to.
+func historyPath() string {
+	return filepath.Join(stateDir(), "history")
+}
+
+// recordUse appends a use of host to the history file, one
+// "RFC3339-time<TAB>alias" line per use.
+func recordUse(host string) error {
+	path := historyPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
 	}
 	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\t%s\n", time.Now().UTC().Format(time.RFC3339), host)
+	return err
+}
+
+// hostUse is how often and when a host was last connected to.
+type hostUse struct {
+	Count int
+	First time.Time
+	Last  time.Time
+}
 
-	hosts := map[string]bool{}
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
+// loadUses reads the history file into per-host use counts. A missing
+// history means no uses.
+func loadUses() (map[string]hostUse, error) {
+	data, err := os.ReadFile(historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]hostUse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	uses := map[string]hostUse{}
+	for _, line := range strings.Split(string(data), "\n") {
+		ts, host, ok := strings.Cut(line, "\t")
+		if !ok || host == "" {
 			continue
 		}
-		fields := strings.Fields(line)
-		if len(fields) > 1 && strings.ToLower(fields[0]) == "host" {
-			for _, h := range fields[1:] {
-				if strings.ContainsAny(h, "*?!") {
-					continue
-				}
-				hosts[h] = true
+		u := uses[host]
+		u.Count++
+		if t, err := time.Parse(time.RFC3339, ts); err == nil {
+			if u.First.IsZero() || t.Before(u.First) {
+				u.First = t
+			}
+			if t.After(u.Last) {
+				u.Last = t
 			}
 		}
+		uses[host] = u
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	return uses, nil
+}
+
+// sortByUse orders hosts most-used first, breaking ties by the most recent
+// use and then alphabetically.
+func sortByUse(hosts []string, uses map[string]hostUse) {
+	sort.SliceStable(hosts, func(i, j int) bool {
+		a, b := uses[hosts[i]], uses[hosts[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Last.After(b.Last)
+	})
+}
+
+// printStats summarizes the connection history: total connections, the
+// most-used hosts, each host's last connection and the average per day.
+func printStats(asJSON bool) error {
+	uses, err := loadUses()
+	if err != nil {
+		return err
+	}
+	hosts := make([]string, 0, len(uses))
+	total := 0
+	var first, last time.Time
+	for h, u := range uses {
+		hosts = append(hosts, h)
+		total += u.Count
+		if !u.First.IsZero() && (first.IsZero() || u.First.Before(first)) {
+			first = u.First
+		}
+		if u.Last.After(last) {
+			last = u.Last
+		}
+	}
+	sort.Strings(hosts)
+	sortByUse(hosts, uses)
+
+	// The average is over the days from the first to the last connection,
+	// counting a single day if they fall on the same one.
+	perDay := 0.0
+	if total > 0 {
+		days := max(last.Sub(first).Hours()/24, 1)
+		perDay = float64(total) / days
+	}
+
+	type hostStat struct {
+		Host  string    `json:"host"`
+		Count int       `json:"count"`
+		Last  time.Time `json:"last"`
+	}
+	stats := make([]hostStat, len(hosts))
+	for i, h := range hosts {
+		stats[i] = hostStat{h, uses[h].Count, uses[h].Last}
+	}
+	top := stats[:min(len(stats), 10)]
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Total  int        `json:"total"`
+			PerDay float64    `json:"per_day"`
+			Top    []hostStat `json:"top"`
+			Hosts  []hostStat `json:"hosts"`
+		}{total, perDay, top, stats})
+	}
+
+	if total == 0 {
+		fmt.Printf("No connections recorded in %s yet.\n", historyPath())
+		return nil
+	}
+	fmt.Printf("%d connection(s) to %d host(s), %.1f per day.\n", total, len(hosts), perDay)
+	fmt.Println("\nTop hosts:")
+	for i, st := range top {
+		fmt.Printf("  %2d. %s (%d)\n", i+1, st.Host, st.Count)
+	}
+	fmt.Println("\nLast connection:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, st := range stats {
+		fmt.Fprintf(tw, "  %s\t%s\n", st.Host, st.Last.Local().Format("2006-01-02 15:04"))
+	}
+	return tw.Flush()
+}
+
+// filterHosts keeps the hosts that contain substr (case-insensitively) and
+// match the shell glob pattern. Empty criteria match every host. When names
+// is set, substr may also match a host's HostName.
+func filterHosts(hosts []string, substr, glob string, names map[string]string) ([]string, error) {
+	substr = strings.ToLower(substr)
+	var out []string
+	for _, h := range hosts {
+		if substr != "" && !strings.Contains(strings.ToLower(h), substr) &&
+			!strings.Contains(strings.ToLower(names[h]), substr) {
+			continue
+		}
+		if glob != "" {
+			ok, err := filepath.Match(glob, h)
+			if err != nil {
+				return nil, fmt.Errorf("bad --glob pattern %q: %w", glob, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		out = append(out, h)
 	}
+	return out, nil
+}
 
-	result := make([]string, 0, len(hosts))
-	for h := range hosts {
-		result = append(result, h)
+// maxCell is the widest a --format table cell may be without --wide.
+const maxCell = 32
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
 	}
-	sort.Strings(result)
-	return result, nil
+	return string([]rune(s)[:n-1]) + "…"
 }
 
-func pickHost(hosts []string) (string, error) {
+// listTable prints an aligned inventory of hosts with the settings ssh
+// resolves for each. Long values are truncated unless wide is set.
+func listTable(config string, hosts []string, wide bool) error {
+	lines, err := readConfigLines(config)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALIAS\tHOSTNAME\tUSER\tPORT\tPROXYJUMP")
+	for _, h := range hosts {
+		opts := resolveLines(lines, h)
+		row := []string{h, lookup(opts, "HostName"), lookup(opts, "User"), lookup(opts, "Port"), lookup(opts, "ProxyJump")}
+		for i, v := range row {
+			v = strings.Trim(v, `"`)
+			if v == "" {
+				v = "-"
+			}
+			if !wide {
+				v = truncate(v, maxCell)
+			}
+			row[i] = v
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// menuLines renders one line per host for the picker, annotating each alias
+// with its use count when uses is set and adding each host's HostName in a
+// second column when names is set. The alias always comes first and is
+// followed by a space, so pickers can recover it as the first field.
+func menuLines(hosts []string, names map[string]string, uses map[string]hostUse) []string {
+	labels := make([]string, len(hosts))
+	width := 0
+	for i, h := range hosts {
+		labels[i] = h
+		if uses != nil {
+			labels[i] = fmt.Sprintf("%s (%d)", h, uses[h].Count)
+		}
+		width = max(width, len(labels[i]))
+	}
+	if names == nil {
+		return labels
+	}
+	lines := make([]string, len(hosts))
+	for i, h := range hosts {
+		lines[i] = fmt.Sprintf("%-*s  %s", width, labels[i], names[h])
+	}
+	return lines
+}
+
+// defaultMenuThreshold is the most hosts the numbered menu offers unless
+// --menu-threshold says otherwise.
+const defaultMenuThreshold = 50
+
+// errTooManyHosts is returned by pickHost when the numbered menu would be
+// too long to be usable.
+var errTooManyHosts = errors.New("too many hosts for the numbered menu")
+
+// pickHost asks the user to choose one of hosts, with fzf if available or
+// from a numbered list otherwise. The numbered list shows page hosts at a
+// time; 0 pages only when the list is taller than the terminal. It is
+// refused for more than threshold hosts, unless threshold is 0.
+func pickHost(hosts []string, names map[string]string, uses map[string]hostUse, page, threshold int) (string, error) {
 	if len(hosts) == 0 {
 		return "", errors.New("no hosts found")
 	}
+	lines := menuLines(hosts, names, uses)
 
 	if _, err := exec.LookPath("fzf"); err == nil {
 		cmd := exec.Command("fzf", "--prompt=ssh → ", "--height=40%", "--reverse", "--border")
-		cmd.Stdin = strings.NewReader(strings.Join(hosts, "\n"))
+		cmd.Stdin = strings.NewReader(strings.Join(lines, "\n"))
 		cmd.Stderr = os.Stderr
 		out, err := cmd.Output()
 		if err != nil {
 			return "", err
 		}
-		return strings.TrimSpace(string(out)), nil
+		// The alias is the first column; anything after it is display only.
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 {
+			return "", nil
+		}
+		return fields[0], nil
+	}
+
+	if threshold > 0 && len(hosts) > threshold {
+		return "", fmt.Errorf("%w (%d, more than --menu-threshold %d)", errTooManyHosts, len(hosts), threshold)
+	}
+
+	// Without fzf, show the numbered list a page at a time when it would not
+	// fit on the terminal.
+	if page <= 0 {
+		if rows := terminalHeight(); rows > 0 && len(lines) > rows-2 {
+			page = max(rows-3, 1)
+		} else {
+			page = len(lines)
+		}
 	}
 
 	fmt.Println("Select a host:")
+	return pickNumbered(hosts, lines, page)
+}
+
+// pickNumbered reads the choice for the numbered menu: a number or an exact
+// alias selects a host at once, and a prefix that matches several aliases
+// shows just those, re-numbered, to choose from.
+func pickNumbered(hosts, lines []string, page int) (string, error) {
+	for start := 0; ; start += page {
+		end := min(start+page, len(lines))
+		for i := start; i < end; i++ {
+			fmt.Printf("%d) %s\n", i+1, lines[i])
+		}
+		if end < len(lines) {
+			fmt.Printf("-- %d-%d of %d, Enter for more --\n", start+1, end, len(lines))
+		}
+		fmt.Print("> ")
+
+		line, err := stdin.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" && end < len(lines) && err == nil {
+			continue
+		}
+		if line == "" {
+			return "", errors.New("invalid choice")
+		}
+		var choice int
+		if _, err := fmt.Sscan(line, &choice); err == nil && strconv.Itoa(choice) == line {
+			if choice < 1 || choice > len(hosts) {
+				return "", errors.New("invalid choice")
+			}
+			return hosts[choice-1], nil
+		}
+
+		var subHosts, subLines []string
+		for i, h := range hosts {
+			if h == line {
+				return h, nil
+			}
+			if strings.HasPrefix(strings.ToLower(h), strings.ToLower(line)) {
+				subHosts = append(subHosts, h)
+				subLines = append(subLines, lines[i])
+			}
+		}
+		switch len(subHosts) {
+		case 0:
+			return "", fmt.Errorf("no host starts with %q", line)
+		case 1:
+			return subHosts[0], nil
+		}
+		fmt.Printf("Hosts starting with %q:\n", line)
+		hosts, lines, start = subHosts, subLines, -page
+	}
+}
+
+// runDoctor prints a diagnostic report of the SSH setup and returns the
+// number of problems that need fixing.
+func runDoctor(config string) int {
+	problems := 0
+	report := func(status, format string, a ...any) {
+		fmt.Printf("%-5s "+format+"\n", append([]any{status}, a...)...)
+	}
+
+	if fi, err := os.Stat(config); err != nil {
+		problems++
+		report("FAIL", "config %s: %v", config, err)
+	} else {
+		mode := fi.Mode().Perm()
+		if mode&0022 != 0 {
+			problems++
+			report("FAIL", "config %s has mode %04o; ssh refuses group/world-writable configs (chmod 600)", config, mode)
+		} else {
+			report("ok", "config %s (mode %04o)", config, mode)
+		}
+		if hosts, err := listHosts(config); err != nil {
+			problems++
+			report("FAIL", "cannot read hosts: %v", err)
+		} else {
+			report("ok", "%d hosts", len(hosts))
+		}
+		if data, err := os.ReadFile(config); err == nil {
+			lines := strings.Split(string(data), "\n")
+			for _, b := range parseBlocks(lines) {
+				if mixedIndent(lines, b) {
+					report("warn", "line %d: Host %s mixes tabs and spaces for indentation", b.Start+1, strings.Join(b.Patterns, " "))
+				}
+			}
+		}
+	}
+
+	for _, tool := range []string{"ssh", "ssh-keyscan", "fzf"} {
+		path, err := exec.LookPath(tool)
+		switch {
+		case err == nil:
+			report("ok", "%s found at %s", tool, path)
+		case tool == "ssh":
+			problems++
+			report("FAIL", "ssh not found on PATH")
+		case tool == "fzf":
+			report("warn", "fzf not found; using the numbered menu")
+		default:
+			report("warn", "%s not found on PATH", tool)
+		}
+	}
+
+	known := knownHostsPath()
+	entries, dups, malformed, err := knownHostsStats(known)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		report("warn", "known_hosts %s does not exist", known)
+	case err != nil:
+		report("warn", "known_hosts %s: %v", known, err)
+	default:
+		report("ok", "known_hosts %s: %d entries", known, entries)
+		if len(dups) > 0 {
+			report("warn", "known_hosts has %d duplicate lines: %v", len(dups), dups)
+		}
+		if len(malformed) > 0 {
+			report("warn", "known_hosts has %d malformed lines: %v", len(malformed), malformed)
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("\n%d problem(s) found.\n", problems)
+	}
+	return problems
+}
+
+// printMetrics writes config health as "name value" lines in the
+// Prometheus text format. Values that cannot be determined are reported as
+// 0, so a scraper always gets every metric: a config that is missing, a
+// directory or cannot be located at all (config is empty) only has
+// ssh_config_perm_ok 0. Hosts and duplicates are counted through Includes.
+func printMetrics(config string) {
+	hosts, _ := listHosts(config)
+
+	permOK := 0
+	if fi, err := os.Stat(config); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0022 == 0 {
+		permOK = 1
+	}
+
+	dups := 0
+	seen := map[string]int{}
+	walkConfig(config, func(file string, n int, line string) {
+		k, v, ok := parseDirective(line)
+		if !ok || !strings.EqualFold(k, "host") {
+			return
+		}
+		for _, p := range strings.Fields(v) {
+			if !strings.ContainsAny(p, "*?!") {
+				seen[p]++
+			}
+		}
+	})
+	for _, n := range seen {
+		if n > 1 {
+			dups++
+		}
+	}
+
+	known := 0
+	if _, err := os.UserHomeDir(); err == nil {
+		known, _, _, _ = knownHostsStats(knownHostsPath())
+	}
+
+	fmt.Printf("ssh_hosts_total %d\n", len(hosts))
+	fmt.Printf("ssh_known_hosts_total %d\n", known)
+	fmt.Printf("ssh_config_perm_ok %d\n", permOK)
+	fmt.Printf("ssh_duplicate_aliases %d\n", dups)
+}
+
+// refreshWorkers bounds how many hosts --refresh-known-hosts scans at once.
+const refreshWorkers = 8
+
+// refreshKnownHosts scans every host of the config, through its ProxyJump
+// if it has one, and adds the current keys to known_hosts, or to the file
+// of the host's "# known-hosts:" comment. With replace set, a host's old
+// entries are removed first, so rotated keys do not linger. It prints a line
+// per host and returns how many failed.
+func refreshKnownHosts(config string, replace bool) (int, error) {
+	lines, err := readConfigLines(config)
+	if err != nil {
+		return 0, err
+	}
+	hosts, err := listHosts(config)
+	if err != nil {
+		return 0, err
+	}
+
+	type scan struct {
+		hostname, port, known string
+		keys                  []string
+		err                   error
+	}
+	scans := make([]scan, len(hosts))
+	sem := make(chan struct{}, refreshWorkers)
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		opts := resolveLines(lines, h)
+		sc := &scans[i]
+		sc.hostname = strings.Trim(lookup(opts, "HostName"), `"`)
+		if sc.hostname == "" {
+			sc.hostname = h
+		}
+		sc.port = lookup(opts, "Port")
+		// A "# known-hosts:" comment sends the host's keys elsewhere.
+		sc.known = knownHostsPath()
+		if f, _ := hostComment(config, h, "known-hosts"); f != "" {
+			sc.known = sshPath(f)
+		}
+		jump := lookup(opts, "ProxyJump")
+		hash := strings.EqualFold(lookup(opts, "HashKnownHosts"), "yes")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if jump != "" && !strings.EqualFold(jump, "none") {
+				sc.keys, sc.err = scanThroughJump(config, h)
+			} else {
+				sc.keys, sc.err = scanWithRetry(sc.hostname, sc.port, hash)
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	var files []string
+	for i, h := range hosts {
+		sc := scans[i]
+		if sc.err == nil {
+			sc.err = os.MkdirAll(filepath.Dir(sc.known), 0700)
+		}
+		if sc.err == nil && replace {
+			if _, err := os.Stat(sc.known); err == nil {
+				sc.err = forgetHost(sc.known, sc.hostname, sc.port)
+			}
+		}
+		if sc.err == nil {
+			sc.err = appendKnownHosts(sc.known, sc.keys)
+		}
+		if sc.err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", h, sc.err)
+			continue
+		}
+		if !slices.Contains(files, sc.known) {
+			files = append(files, sc.known)
+		}
+		fmt.Printf("ok    %s: %d key(s) in %s\n", h, len(sc.keys), sc.known)
+	}
+	fmt.Printf("\n%d of %d host(s) refreshed in %s.\n", len(hosts)-failed, len(hosts), strings.Join(files, ", "))
+	return failed, nil
+}
+
+// dialWorkers bounds how many hosts --only-reachable dials at once.
+const dialWorkers = 32
+
+// reachableHosts returns the hosts that accept a TCP connection on their
+// HostName and Port within timeout, keeping their order. Hosts behind a
+// ProxyJump cannot be dialed directly and are always kept.
+func reachableHosts(config string, hosts []string, timeout time.Duration) ([]string, error) {
+	lines, err := readConfigLines(config)
+	if err != nil {
+		return nil, err
+	}
+
+	up := make([]bool, len(hosts))
+	sem := make(chan struct{}, dialWorkers)
+	var wg sync.WaitGroup
 	for i, h := range hosts {
-		fmt.Printf("%d) %s\n", i+1, h)
+		opts := resolveLines(lines, h)
+		if jump := lookup(opts, "ProxyJump"); jump != "" && !strings.EqualFold(jump, "none") {
+			up[i] = true
+			continue
+		}
+		hostname := strings.ReplaceAll(strings.Trim(lookup(opts, "HostName"), `"`), "%h", h)
+		if hostname == "" {
+			hostname = h
+		}
+		port := lookup(opts, "Port")
+		if port == "" {
+			port = "22"
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if conn, err := net.DialTimeout("tcp", net.JoinHostPort(hostname, port), timeout); err == nil {
+				conn.Close()
+				up[i] = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	var live []string
+	for i, h := range hosts {
+		if up[i] {
+			live = append(live, h)
+		}
+	}
+	return live, nil
+}
+
+// clipboardCommand returns the command that writes stdin to the system
+// clipboard, or nil if no clipboard tool is available.
+func clipboardCommand() []string {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"clip.exe"}}
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, []string{"wl-copy"})
+		}
+		candidates = append(candidates,
+			[]string{"xclip", "-selection", "clipboard"},
+			[]string{"xsel", "--clipboard", "--input"},
+			[]string{"clip.exe"}, // WSL
+		)
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// copyToClipboard puts text on the clipboard, printing it instead when no
+// clipboard tool is available.
+func copyToClipboard(text string) error {
+	c := clipboardCommand()
+	if c == nil {
+		fmt.Fprintln(os.Stderr, "No clipboard tool found (pbcopy, wl-copy, xclip, xsel, clip.exe); printing instead.")
+		fmt.Println(text)
+		return nil
+	}
+	cmd := exec.Command(c[0], c[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", c[0], err)
+	}
+	fmt.Fprintf(os.Stderr, "Copied to clipboard: %s\n", text)
+	return nil
+}
+
+// hostComment returns the value of the "# key:" comment in alias's block,
+// looking in the config and the files it includes.
+func hostComment(config, alias, key string) (string, error) {
+	for _, f := range append([]string{config}, includedFiles(config)...) {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		lines := strings.Split(string(data), "\n")
+		if b, ok := findBlock(lines, alias); ok {
+			return blockComment(lines, b, key), nil
+		}
 	}
-	fmt.Print("> ")
+	return "", fmt.Errorf("host %q is not defined in %s", alias, config)
+}
 
-	var choice int
-	_, err := fmt.Scan(&choice)
-	if err != nil || choice < 1 || choice > len(hosts) {
-		return "", errors.New("invalid choice")
+// webURL returns the "# web:" URL of alias's block, with {hostname}
+// replaced by the host's HostName, or "" if the block has none.
+func webURL(config, alias string) (string, error) {
+	url, err := hostComment(config, alias, "web")
+	if err != nil || url == "" {
+		return "", err
 	}
-	return hosts[choice-1], nil
+	names, err := hostNames(config, []string{alias})
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(url, "{hostname}", names[alias]), nil
 }
 
-func usage() {
-	prog := filepath.Base(os.Args[0])
-	fmt.Printf(`Usage: %s [--sftp] [--print] [-- command args...]
-(no args) → pick a host and ssh into it
---sftp   → pick a host and open sftp
---print  → just print chosen host
+// openBrowser opens url with the platform's default handler.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// shellQuote quotes s for a POSIX shell if it contains anything special.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// touch records a use of alias without connecting, after checking that the
+// alias is defined in the config.
+func touch(config, alias string) {
+	hosts, err := listHosts(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	i := sort.SearchStrings(hosts, alias)
+	if i == len(hosts) || hosts[i] != alias {
+		fmt.Fprintf(os.Stderr, "Host \"%s\" is not defined in %s\n", alias, config)
+		os.Exit(1)
+	}
+	if err := recordUse(alias); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// cdCommand returns the remote command that changes to dir and starts an
+// interactive login shell there. A leading ~/ is left unquoted so the remote
+// shell expands it.
+func cdCommand(dir string) string {
+	quoted := shellQuote(dir)
+	if dir == "~" {
+		quoted = "~"
+	} else if rest, ok := strings.CutPrefix(dir, "~/"); ok {
+		quoted = "~/" + shellQuote(rest)
+	}
+	return fmt.Sprintf("cd %s && exec \"$SHELL\" -l", quoted)
+}
+
+// shellJoin quotes argv into a single shell command line.
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, a := range argv {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func menuUsage() {
+	fmt.Printf(`Usage: %s [--sftp] [--print] [--filter text] [--glob pattern] [--select-first] [--only-reachable [--timeout duration]] [--page N] [--menu-threshold N] [--show-hostname] [--show-uses] [--sort alpha|hostname|recent|none] [--reverse] [--list [--format plain|table] [--wide]] [--describe] [--json] [--copy|--copy-command] [--cd dir] [--as user] [--forward-agent|--no-forward-agent] [--become alias] [--run-local cmd] [--after cmd [--after-on-success-only]] [--dry-run] [--touch alias] [--web alias] [--which alias [--json]] [--audit-keys [--strict]] [--doctor] [--refresh-known-hosts [--force]] [--metrics] [--stats [--json]] [--diff-profiles a b [--json]] [-- command args...]
+(no args)       → pick a host and ssh into it
+--sftp          → pick a host and open sftp
+--print         → just print chosen host
+--show-hostname → list each host's HostName next to its alias, so both
+                  the picker and --filter match on either
+--list          → print the (filtered) hosts instead of picking one
+--format table  → with --list, print an aligned table of alias, HostName,
+                  User, Port and ProxyJump (default: plain, one per line)
+--wide          → with --format table, don't truncate long values
+--show-uses     → show how often each host was used, e.g. "web-prod (42)"
+--recent        → list the most-used hosts first (same as --sort recent)
+--sort order    → alpha (default), hostname, recent, or none (file order)
+--reverse       → reverse the sort order, e.g. --sort none --reverse for
+                  the newest additions first
+--describe      → print the settings ssh would use for the chosen host
+--json          → with --print/--describe, print the settings as JSON
+--copy          → copy the chosen host alias to the clipboard
+--copy-command  → copy the full ssh/sftp command to the clipboard
+--filter text   → only offer hosts whose alias contains text
+--glob pattern  → only offer hosts whose alias matches a shell glob
+                  (a single match is used without asking)
+--cd dir        → after login, change to dir and start an interactive shell
+--as user       → connect as user instead of the configured User
+--forward-agent, --no-forward-agent
+                → turn agent forwarding on (-A) or off (-a) for this
+                  connection, whatever the config says
+--become alias  → connect to alias and run the escalation command from its
+                  "# become: sudo -i" comment (e.g. to get a root shell); the
+                  comment is a remote shell command line, passed to ssh as is
+--run-local cmd → run a local shell command instead of ssh, with {host}
+                  replaced by the chosen alias
+--after cmd     → run a local shell command when the session ends, with
+                  {host} replaced by the alias and {exit} by ssh's exit code;
+                  --after-on-success-only skips it if the session failed
+                  (the exit code is always that of the session)
+--dry-run       → print the command instead of running it
+--web alias     → open the URL from the host's "# web: https://{hostname}:8443"
+                  comment in the browser ({hostname} is its HostName)
+--which alias   → print the file and line of alias's Host line, following
+                  Includes (--json for JSON); exits 1 if it is not defined
+--touch alias   → record a use of alias in the history without connecting
+--audit-keys    → list hosts whose IdentityFile keys are missing
+                  (--strict exits non-zero if any are)
+--refresh-known-hosts
+                → scan every host (through its ProxyJump if any) and add its
+                  current keys to known_hosts (or its "# known-hosts:" file);
+                  --force first removes the host's old entries, e.g. after a
+                  key rotation
+--metrics       → print config health metrics (hosts, known_hosts entries,
+                  config permissions, duplicate aliases) as "name value" lines
+--stats         → summarize the connection history (--json for JSON)
+--diff-profiles a b
+                → compare two config files: hosts only in a, only in b, and
+                  those whose blocks set different directives (--json for
+                  JSON); exits 1 if they differ
+--doctor        → check the config, known_hosts and required tools
+--only-reachable
+                → only offer hosts that accept a TCP connection on their
+                  HostName:Port right now (hosts behind a ProxyJump are kept)
+--timeout d     → with --only-reachable, how long to wait per host
+                  (default 1s, e.g. 500ms or 3s)
+--page N        → without fzf, show the numbered list N hosts at a time
+                  (by default it pages when taller than the terminal)
+--menu-threshold N
+                → without fzf, refuse the numbered list for more than N hosts
+                  and ask for --filter or --glob instead (default 50, 0 for
+                  no limit)
+--select-first  → with --filter/--glob, take the first match in --sort order
+                  (alphabetical, byte-wise, by default) instead of asking
+--config path   → use another SSH config (default: $SSH_CONFIG or ~/.ssh/config)
+--print-config-path, --print-known-hosts-path
+                → print the path that would be used and exit
 Examples:
   %s
   %s --sftp
+  %s --glob 'web-*'
+  %s --cd /var/www --as deploy
+  %s --run-local 'scp ./deploy.sh {host}:/tmp && ssh {host} bash /tmp/deploy.sh'
   %s -- -L 8080:localhost:80
-`, prog, prog, prog, prog)
+`, prog, prog, prog, prog, prog, prog, prog)
 }
 
-func main() {
-	config := sshConfigPath()
-	if _, err := os.Stat(config); err != nil {
-		fmt.Fprintf(os.Stderr, "No readable SSH config at %s\n", config)
-		os.Exit(1)
+func menuMain(args []string) {
+	config, err := configPath()
+	if err != nil && !slices.Contains(args, "--metrics") {
+		log.Fatal(err)
 	}
 
 	mode := "ssh"
 	printOnly := false
+	describe, asJSON := false, false
+	copyMode := ""
+	audit, strict := false, false
+	runLocal, dryRun := "", false
+	after, afterSuccessOnly := "", false
+	cd, as := "", ""
+	forwardAgent := ""
+	becomeHost := ""
+	showHostname := false
+	showUses, stats := false, false
+	refresh, replaceKeys := false, false
+	var diffPaths []string
+	which := ""
+	sortBy, reverse := "alpha", false
+	filter, glob := "", ""
+	selectFirst := false
+	onlyReachable, dialTimeout := false, time.Second
+	list, format, wide := false, "plain", false
+	page, threshold := 0, defaultMenuThreshold
 	var passArgs []string
 
-	args := os.Args[1:]
 	for len(args) > 0 {
 		switch args[0] {
 		case "--sftp":
@@ -122,8 +995,206 @@ func main() {
 		case "--print":
 			printOnly = true
 			args = args[1:]
+		case "--copy", "--copy-command":
+			copyMode = args[0]
+			args = args[1:]
+		case "--describe":
+			describe = true
+			args = args[1:]
+		case "--json":
+			asJSON = true
+			args = args[1:]
+		case "--audit-keys":
+			audit = true
+			args = args[1:]
+		case "--strict":
+			strict = true
+			args = args[1:]
+		case "--doctor":
+			if runDoctor(config) > 0 {
+				os.Exit(1)
+			}
+			return
+		case "--refresh-known-hosts":
+			refresh = true
+			args = args[1:]
+		case "--force":
+			replaceKeys = true
+			args = args[1:]
+		case "--metrics":
+			printMetrics(config)
+			return
+		case "--which":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--which requires a host alias")
+				os.Exit(1)
+			}
+			which = args[1]
+			args = args[2:]
+		case "--diff-profiles":
+			if len(args) < 3 {
+				fmt.Fprintln(os.Stderr, "--diff-profiles requires two config files")
+				os.Exit(1)
+			}
+			diffPaths = args[1:3]
+			args = args[3:]
+		case "--show-hostname":
+			showHostname = true
+			args = args[1:]
+		case "--stats":
+			stats = true
+			args = args[1:]
+		case "--show-uses":
+			showUses = true
+			args = args[1:]
+		case "--recent":
+			sortBy = "recent"
+			args = args[1:]
+		case "--sort":
+			if len(args) < 2 || !slices.Contains([]string{"alpha", "hostname", "recent", "none"}, args[1]) {
+				fmt.Fprintln(os.Stderr, "--sort must be alpha, hostname, recent or none")
+				os.Exit(1)
+			}
+			sortBy = args[1]
+			args = args[2:]
+		case "--reverse":
+			reverse = true
+			args = args[1:]
+		case "--select-first":
+			selectFirst = true
+			args = args[1:]
+		case "--only-reachable":
+			onlyReachable = true
+			args = args[1:]
+		case "--timeout":
+			var d time.Duration
+			if len(args) > 1 {
+				d, _ = time.ParseDuration(args[1])
+			}
+			if d <= 0 {
+				fmt.Fprintln(os.Stderr, "--timeout requires a positive duration, e.g. 500ms or 2s")
+				os.Exit(1)
+			}
+			dialTimeout = d
+			args = args[2:]
+		case "--list":
+			list = true
+			args = args[1:]
+		case "--wide":
+			wide = true
+			args = args[1:]
+		case "--format":
+			if len(args) < 2 || (args[1] != "plain" && args[1] != "table") {
+				fmt.Fprintln(os.Stderr, "--format must be plain or table")
+				os.Exit(1)
+			}
+			format = args[1]
+			args = args[2:]
+		case "--touch":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--touch requires a host alias")
+				os.Exit(1)
+			}
+			touch(config, args[1])
+			return
+		case "--web":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--web requires a host alias")
+				os.Exit(1)
+			}
+			url, err := webURL(config, args[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			if url == "" {
+				fmt.Printf("Host \"%s\" has no \"# web:\" comment; nothing to open.\n", args[1])
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Opening %s\n", url)
+			if err := openBrowser(url); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "--run-local":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--run-local requires a command")
+				os.Exit(1)
+			}
+			runLocal = args[1]
+			args = args[2:]
+		case "--become":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--become requires a host alias")
+				os.Exit(1)
+			}
+			becomeHost = args[1]
+			args = args[2:]
+		case "--cd", "--as":
+			if len(args) < 2 || args[1] == "" {
+				fmt.Fprintf(os.Stderr, "%s requires a value\n", args[0])
+				os.Exit(1)
+			}
+			if args[0] == "--cd" {
+				cd = args[1]
+			} else {
+				as = args[1]
+			}
+			args = args[2:]
+		case "--forward-agent", "--no-forward-agent":
+			if forwardAgent != "" && forwardAgent != args[0] {
+				fmt.Fprintln(os.Stderr, "--forward-agent cannot be combined with --no-forward-agent")
+				os.Exit(1)
+			}
+			forwardAgent = args[0]
+			args = args[1:]
+		case "--after":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--after requires a command")
+				os.Exit(1)
+			}
+			after = args[1]
+			args = args[2:]
+		case "--after-on-success-only":
+			afterSuccessOnly = true
+			args = args[1:]
+		case "--dry-run":
+			dryRun = true
+			args = args[1:]
+		case "--page":
+			n := 0
+			if len(args) > 1 {
+				fmt.Sscan(args[1], &n)
+			}
+			if n < 1 {
+				fmt.Fprintln(os.Stderr, "--page requires a positive number")
+				os.Exit(1)
+			}
+			page = n
+			args = args[2:]
+		case "--menu-threshold":
+			n := -1
+			if len(args) > 1 {
+				fmt.Sscan(args[1], &n)
+			}
+			if n < 0 {
+				fmt.Fprintln(os.Stderr, "--menu-threshold requires a number (0 for no limit)")
+				os.Exit(1)
+			}
+			threshold = n
+			args = args[2:]
+		case "--filter", "--glob":
+			if len(args) < 2 {
+				fmt.Fprintf(os.Stderr, "%s requires a value\n", args[0])
+				os.Exit(1)
+			}
+			if args[0] == "--filter" {
+				filter = args[1]
+			} else {
+				glob = args[1]
+			}
+			args = args[2:]
 		case "-h", "--help":
-			usage()
+			menuUsage()
 			return
 		case "--":
 			passArgs = args[1:]
@@ -134,33 +1205,290 @@ func main() {
 		}
 	}
 
-	hosts, err := listHosts(config)
+	if stats {
+		if err := printStats(asJSON); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if diffPaths != nil {
+		d, err := diffProfiles(diffPaths[0], diffPaths[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		differ, err := printProfileDiff(d, diffPaths[0], diffPaths[1], asJSON)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if differ {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if _, err := os.Stat(config); err != nil {
+		fmt.Fprintf(os.Stderr, "No readable SSH config at %s\n", config)
+		os.Exit(1)
+	}
+
+	if which != "" {
+		locs := findDefinitions(config, which)
+		if len(locs) == 0 {
+			fmt.Fprintf(os.Stderr, "Host \"%s\" is not defined in %s or its Includes.\n", which, config)
+			os.Exit(1)
+		}
+		if asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(locs); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		for i, l := range locs {
+			if i == 0 {
+				fmt.Printf("%s:%d\n", l.File, l.Line)
+				continue
+			}
+			fmt.Printf("%s:%d (also; the first one wins for settings both set)\n", l.File, l.Line)
+		}
+		return
+	}
+
+	if refresh {
+		failed, err := refreshKnownHosts(config, replaceKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if audit {
+		bad, err := auditKeys(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if strict && bad > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cd != "" && mode == "sftp" {
+		fmt.Fprintln(os.Stderr, "--cd cannot be combined with --sftp")
+		os.Exit(1)
+	}
+
+	if selectFirst && filter == "" && glob == "" {
+		fmt.Fprintln(os.Stderr, "--select-first requires --filter or --glob")
+		os.Exit(1)
+	}
+
+	var hosts []string
+	if sortBy == "none" {
+		hosts, err = listHostsInOrder(config)
+	} else {
+		hosts, err = listHosts(config)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	host, err := pickHost(hosts)
+	var names map[string]string
+	if showHostname || sortBy == "hostname" {
+		if names, err = hostNames(config, hosts); err != nil {
+			log.Fatal(err)
+		}
+		if sortBy == "hostname" {
+			sort.SliceStable(hosts, func(i, j int) bool { return names[hosts[i]] < names[hosts[j]] })
+		}
+		if !showHostname {
+			names = nil
+		}
+	}
+	var uses map[string]hostUse
+	if showUses || sortBy == "recent" {
+		all, err := loadUses()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sortBy == "recent" {
+			sortByUse(hosts, all)
+		}
+		if showUses {
+			uses = all
+		}
+	}
+	if reverse {
+		slices.Reverse(hosts)
+	}
+	if filter != "" || glob != "" {
+		hosts, err = filterHosts(hosts, filter, glob, names)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(hosts) == 0 {
+			fmt.Fprintln(os.Stderr, "No hosts match.")
+			os.Exit(1)
+		}
+	}
+	if onlyReachable {
+		live, err := reachableHosts(config, hosts, dialTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d host(s) unreachable, not shown.\n", len(hosts)-len(live), len(hosts))
+		if len(live) == 0 {
+			os.Exit(1)
+		}
+		hosts = live
+	}
+
+	if list {
+		if format == "table" {
+			if err := listTable(config, hosts, wide); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		for _, l := range menuLines(hosts, names, uses) {
+			fmt.Println(l)
+		}
+		return
+	}
+
+	// --become names the host itself and runs its "# become:" command
+	// after login.
+	host, become := "", ""
+	if becomeHost != "" {
+		if become, err = hostComment(config, becomeHost, "become"); err != nil {
+			log.Fatal(err)
+		}
+		if become == "" {
+			fmt.Fprintf(os.Stderr, "Host \"%s\" has no \"# become:\" comment (add one with ssh-add-host --become).\n", becomeHost)
+			os.Exit(1)
+		}
+		if cd != "" {
+			fmt.Fprintln(os.Stderr, "--become cannot be combined with --cd")
+			os.Exit(1)
+		}
+		host = becomeHost
+	}
+
+	// hosts is in --sort order (alphabetical by default), so hosts[0] is the
+	// first match.
+	switch {
+	case host != "": // named with --become
+	case (len(hosts) == 1 || selectFirst) && (filter != "" || glob != ""):
+		host = hosts[0]
+	default:
+		host, err = pickHost(hosts, names, uses, page, threshold)
+	}
+	if errors.Is(err, errTooManyHosts) {
+		fmt.Fprintf(os.Stderr, "%v.\nInstall fzf, or narrow the list with --filter or --glob (--menu-threshold 0 shows it anyway).\n", err)
+		os.Exit(1)
+	}
 	if err != nil || host == "" {
 		fmt.Fprintln(os.Stderr, "No host selected.")
 		os.Exit(1)
 	}
 
+	if describe || (printOnly && asJSON) {
+		if err := describeHost(config, host, asJSON); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if printOnly {
 		fmt.Println(host)
 		return
 	}
 
-	var cmd *exec.Cmd
+	argv := []string{mode}
+	if as != "" {
+		argv = append(argv, "-o", "User="+as)
+	}
+	// sftp has no -A/-a, so it gets the equivalent option.
+	switch {
+	case forwardAgent == "--forward-agent" && mode == "sftp":
+		argv = append(argv, "-o", "ForwardAgent=yes")
+	case forwardAgent == "--no-forward-agent" && mode == "sftp":
+		argv = append(argv, "-o", "ForwardAgent=no")
+	case forwardAgent == "--forward-agent":
+		argv = append(argv, "-A")
+	case forwardAgent == "--no-forward-agent":
+		argv = append(argv, "-a")
+	}
 	if mode == "sftp" {
-		cmd = exec.Command("sftp", host)
+		argv = append(argv, host)
+	} else if cd != "" || become != "" {
+		remote := become
+		if cd != "" {
+			remote = cdCommand(cd)
+		}
+		argv = append(argv, "-t")
+		argv = append(argv, passArgs...)
+		argv = append(argv, host, remote)
 	} else {
-		cmd = exec.Command("ssh", append([]string{host}, passArgs...)...)
+		argv = append(argv, host)
+		argv = append(argv, passArgs...)
 	}
 
+	switch copyMode {
+	case "--copy":
+		if err := copyToClipboard(host); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "--copy-command":
+		if err := copyToClipboard(shellJoin(argv)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if runLocal != "" {
+		local := strings.ReplaceAll(runLocal, "{host}", shellQuote(host))
+		fmt.Fprintf(os.Stderr, "+ %s\n", local)
+		argv = []string{"sh", "-c", local}
+	} else if dryRun {
+		fmt.Println(shellJoin(argv))
+	}
+	if dryRun {
+		return
+	}
+
+	if err := recordUse(host); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot record history: %v\n", err)
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	err = cmd.Run()
-	if err != nil {
-		os.Exit(cmd.ProcessState.ExitCode())
+	if err != nil && cmd.ProcessState == nil {
+		log.Fatal(err)
+	}
+	code := cmd.ProcessState.ExitCode()
+
+	// The --after command's own failure does not change the exit code,
+	// which stays that of the session.
+	if after != "" && (code == 0 || !afterSuccessOnly) {
+		local := strings.ReplaceAll(after, "{host}", shellQuote(host))
+		local = strings.ReplaceAll(local, "{exit}", strconv.Itoa(code))
+		post := exec.Command("sh", "-c", local)
+		post.Stdin, post.Stdout, post.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := post.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: --after command failed: %v\n", err)
+		}
+	}
+	if code != 0 {
+		os.Exit(code)
 	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func removeUsage() {
+	fmt.Printf(`Usage: %s [-y|-f] [--forget-keys] [--backup-dir dir] alias
+Removes the Host block for alias from the SSH config, keeping a backup
+(next to the config, or in --backup-dir). The block is shown first and
+must be confirmed: answer y to remove it, or k to also remove the host's
+known_hosts entries.
+  -y, -f          Remove without asking
+  --forget-keys   Also remove the host's known_hosts entries (with -y)
+`, prog)
+}
+
+func removeMain(args []string) {
+	fs := flag.NewFlagSet(prog, flag.ExitOnError)
+	fs.Usage = removeUsage
+	fs.StringVar(&backupDir, "backup-dir", "", "directory for config backups")
+	var yes, forgetKeys bool
+	fs.BoolVar(&yes, "y", false, "remove without asking")
+	fs.BoolVar(&yes, "f", false, "remove without asking")
+	fs.BoolVar(&forgetKeys, "forget-keys", false, "also remove the host's known_hosts entries")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		removeUsage()
+		os.Exit(2)
+	}
+	alias := fs.Arg(0)
+
+	config := sshConfigPath()
+	data, err := os.ReadFile(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	b, ok := findBlock(lines, alias)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Host \"%s\" not found in %s.\n", alias, config)
+		os.Exit(1)
+	}
+	if handWritten(config, alias) {
+		fmt.Fprintf(os.Stderr, "Host \"%s\" in %s is outside the managed region; remove it by hand.\n", alias, config)
+		os.Exit(1)
+	}
+	block := strings.TrimRight(strings.Join(lines[b.Start:b.End], "\n"), "\n \t")
+
+	// The known_hosts entries are looked up before the block is gone.
+	opts := resolveLines(lines, alias)
+	hostname := strings.Trim(lookup(opts, "HostName"), `"`)
+	if hostname == "" {
+		hostname = alias
+	}
+	port := lookup(opts, "Port")
+	known := knownHostsPath()
+	if f := blockComment(lines, b, "known-hosts"); f != "" {
+		known = sshPath(f)
+	}
+
+	if !yes {
+		fmt.Printf("%s\n\n", block)
+		fmt.Printf("Remove this host? [y/N, k = also remove its keys from %s]: ", known)
+		line, _ := stdin.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+		case "k":
+			forgetKeys = true
+		default:
+			fmt.Println("Nothing removed.")
+			return
+		}
+	}
+
+	if err := removeExistingAlias(config, alias); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Removed Host \"%s\" from %s:\n%s\n", alias, config, block)
+	if forgetKeys {
+		if _, err := os.Stat(known); err != nil {
+			return
+		}
+		if err := forgetHost(known, hostname, port); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot remove known_hosts entries: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed the known_hosts entries for %s from %s.\n", hostname, known)
+	}
+}
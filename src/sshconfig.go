@@ -0,0 +1,606 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// configOverride is the config path given with --config, or that of the
+// --context, if any.
+var configOverride string
+
+// sshConfigPath returns the config the tools work on: --config or
+// --context, then $SSH_CONFIG, then ~/.ssh/config.
+func sshConfigPath() string {
+	path, err := configPath()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path
+}
+
+// configPath is sshConfigPath returning an error, rather than exiting, when
+// the home directory is unknown.
+func configPath() (string, error) {
+	if configOverride != "" {
+		return configOverride, nil
+	}
+	if path := os.Getenv("SSH_CONFIG"); path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot get home dir: %w", err)
+	}
+	return filepath.Join(home, ".ssh", "config"), nil
+}
+
+// stateDir returns the directory for the tools' own state, such as history.
+func stateDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatalf("cannot get home dir: %v", err)
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "my-ssh-tools")
+}
+
+// directive is a single "Key value" line of a config block.
+type directive struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// parseDirective splits a config line into its keyword and value, accepting
+// both "Key value" and "Key=value" forms. Blank lines and comments are skipped.
+func parseDirective(line string) (key, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, "", true
+	}
+	value = strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	return line[:i], value, true
+}
+
+// matchPattern matches s against an ssh host pattern, where '*' matches any
+// run of characters and '?' matches exactly one.
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// hostMatches reports whether alias is selected by a Host line's patterns.
+// As in ssh, a matching negated pattern ("!pat") excludes the alias outright.
+func hostMatches(patterns []string, alias string) bool {
+	alias = strings.ToLower(alias)
+	matched := false
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if strings.HasPrefix(p, "!") {
+			if matchPattern(p[1:], alias) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(p, alias) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// multiValued lists the directives ssh accumulates instead of keeping only
+// the first value.
+var multiValued = map[string]bool{
+	"identityfile":    true,
+	"certificatefile": true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"dynamicforward":  true,
+	"sendenv":         true,
+}
+
+// resolveHost collects the directives that apply to alias in the order ssh
+// obtains them: every Host block whose patterns select the alias contributes,
+// and the first value of a directive wins unless ssh accumulates it. Match
+// blocks are not evaluated and are treated as not applying.
+func resolveHost(config, alias string) ([]directive, error) {
+	lines, err := readConfigLines(config)
+	if err != nil {
+		return nil, err
+	}
+	return resolveLines(lines, alias), nil
+}
+
+// resolveLines is resolveHost for a config that has already been read.
+func resolveLines(lines []string, alias string) []directive {
+	var out []directive
+	seen := map[string]bool{}
+	active := true
+	for _, line := range lines {
+		k, v, ok := parseDirective(line)
+		if !ok {
+			continue
+		}
+		lk := strings.ToLower(k)
+		switch lk {
+		case "host":
+			active = hostMatches(strings.Fields(v), alias)
+			continue
+		case "match":
+			active = false
+			continue
+		case "include":
+			continue // readConfigLines has put the files' lines in its place
+		}
+		if !active || (seen[lk] && !multiValued[lk]) {
+			continue
+		}
+		seen[lk] = true
+		out = append(out, directive{k, v})
+	}
+	return out
+}
+
+// rawValue lists directives whose value is several arguments or a command
+// line, which must be written as given rather than quoted as one argument.
+var rawValue = map[string]bool{
+	"localforward":         true,
+	"remoteforward":        true,
+	"permitremoteopen":     true,
+	"sendenv":              true,
+	"setenv":               true,
+	"userknownhostsfile":   true,
+	"globalknownhostsfile": true,
+	"canonicaldomains":     true,
+	"proxycommand":         true,
+	"localcommand":         true,
+	"remotecommand":        true,
+	"knownhostscommand":    true,
+}
+
+// configValue returns value as it should be written for key: wrapped in
+// double quotes if it contains whitespace, so ssh reads it as a single
+// argument (for example an IdentityFile path with a space).
+func configValue(key, value string) string {
+	if rawValue[strings.ToLower(key)] || !strings.ContainsAny(value, " \t") ||
+		(len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`)) {
+		return value
+	}
+	return `"` + value + `"`
+}
+
+// lookup returns the first value of key among resolved directives.
+func lookup(opts []directive, key string) string {
+	for _, d := range opts {
+		if strings.EqualFold(d.Key, key) {
+			return d.Value
+		}
+	}
+	return ""
+}
+
+// listHosts returns the config's concrete host aliases (no patterns),
+// sorted alphabetically.
+func listHosts(config string) ([]string, error) {
+	hosts, err := listHostsInOrder(config)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// listHostsInOrder returns the config's concrete host aliases in the order
+// they first appear in it or the files it includes.
+func listHostsInOrder(config string) ([]string, error) {
+	lines, err := readConfigLines(config)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var hosts []string
+	for _, line := range lines {
+		k, v, ok := parseDirective(line)
+		if !ok || !strings.EqualFold(k, "host") {
+			continue
+		}
+		for _, h := range strings.Fields(v) {
+			if strings.ContainsAny(h, "*?!") || seen[h] {
+				continue
+			}
+			seen[h] = true
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, nil
+}
+
+// hostBlock locates a Host section within the lines of a config file.
+type hostBlock struct {
+	Patterns []string
+	Start    int // index of the Host line
+	End      int // index one past the block's last line
+}
+
+// The markers of the region ssh-add-host manages in a config. Blocks
+// outside it are the user's and are never rewritten.
+const (
+	managedBegin = "# >>> ssh-tools managed >>>"
+	managedEnd   = "# <<< ssh-tools managed <<<"
+)
+
+// isMarker reports whether line is a managed region marker.
+func isMarker(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == managedBegin || line == managedEnd
+}
+
+// managedRegion returns the indexes of the begin and end markers of the
+// managed region, if lines have one.
+func managedRegion(lines []string) (begin, end int, ok bool) {
+	begin = slices.IndexFunc(lines, func(l string) bool { return strings.TrimSpace(l) == managedBegin })
+	if begin < 0 {
+		return 0, 0, false
+	}
+	for i := begin + 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == managedEnd {
+			return begin, i, true
+		}
+	}
+	return 0, 0, false
+}
+
+// inRegion reports whether b lies between the markers begin and end.
+func (b hostBlock) inRegion(begin, end int) bool {
+	return b.Start > begin && b.Start < end
+}
+
+// isDisabledHeader reports whether line is a Host or Match line commented
+// out, as --disable leaves it.
+func isDisabledHeader(line string) bool {
+	text, ok := uncomment(line)
+	if !ok || isMarker(line) {
+		return false
+	}
+	k, _, ok := parseDirective(text)
+	return ok && (strings.EqualFold(k, "host") || strings.EqualFold(k, "match"))
+}
+
+// parseBlocks splits config lines into Host sections. A section runs from
+// its Host line up to the next Host or Match line, disabled Host or Match
+// line, managed region marker, or the end of the file.
+func parseBlocks(lines []string) []hostBlock {
+	var blocks []hostBlock
+	open := -1
+	for i, line := range lines {
+		if isMarker(line) || isDisabledHeader(line) {
+			if open >= 0 {
+				blocks[open].End = i
+				open = -1
+			}
+			continue
+		}
+		k, v, ok := parseDirective(line)
+		if !ok || !(strings.EqualFold(k, "host") || strings.EqualFold(k, "match")) {
+			continue
+		}
+		if open >= 0 {
+			blocks[open].End = i
+			open = -1
+		}
+		if strings.EqualFold(k, "host") {
+			blocks = append(blocks, hostBlock{Patterns: strings.Fields(v), Start: i})
+			open = len(blocks) - 1
+		}
+	}
+	if open >= 0 {
+		blocks[open].End = len(lines)
+	}
+	return blocks
+}
+
+// hasAlias reports whether alias is listed verbatim on the block's Host line.
+func (b hostBlock) hasAlias(alias string) bool {
+	for _, p := range b.Patterns {
+		if p == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// findBlock returns the first block that lists alias on its Host line.
+func findBlock(lines []string, alias string) (hostBlock, bool) {
+	for _, b := range parseBlocks(lines) {
+		if b.hasAlias(alias) {
+			return b, true
+		}
+	}
+	return hostBlock{}, false
+}
+
+// uncomment strips one level of "# " (or "#") from a commented-out line.
+func uncomment(line string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimLeft(line, " \t"), "#")
+	if !ok {
+		return line, false
+	}
+	return strings.TrimPrefix(rest, " "), true
+}
+
+// findDisabledBlock finds a Host block for alias that has been commented
+// out line by line, as --disable does. The block runs from its "# Host" line
+// over the following commented lines, up to the next commented Host or Match
+// line, a managed region marker, or the first line that is not a comment.
+func findDisabledBlock(lines []string, alias string) (hostBlock, bool) {
+	for i, line := range lines {
+		text, ok := uncomment(line)
+		if !ok {
+			continue
+		}
+		k, v, ok := parseDirective(text)
+		if !ok || !strings.EqualFold(k, "host") {
+			continue
+		}
+		b := hostBlock{Patterns: strings.Fields(v), Start: i, End: len(lines)}
+		if !b.hasAlias(alias) {
+			continue
+		}
+		for j := i + 1; j < len(lines); j++ {
+			text, ok := uncomment(lines[j])
+			if !ok || isMarker(lines[j]) {
+				b.End = j
+				break
+			}
+			if k, _, ok := parseDirective(text); ok && (strings.EqualFold(k, "host") || strings.EqualFold(k, "match")) {
+				b.End = j
+				break
+			}
+		}
+		return b, true
+	}
+	return hostBlock{}, false
+}
+
+// blockComment returns the value of a "# key: value" comment inside block
+// b, or "" if there is none. The tools use such comments for settings of
+// their own that ssh does not know about.
+func blockComment(lines []string, b hostBlock, key string) string {
+	for _, line := range lines[b.Start+1 : b.End] {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimSpace(line[1:]), ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), key) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// blockIndent returns the indentation most of the block's directives use
+// (the earliest one on a tie), or "" if the block has no indented
+// directives.
+func blockIndent(lines []string, b hostBlock) string {
+	count := map[string]int{}
+	best := ""
+	for _, line := range lines[b.Start+1 : b.End] {
+		if _, _, ok := parseDirective(line); !ok {
+			continue
+		}
+		ws := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if ws == "" {
+			continue
+		}
+		count[ws]++
+		if best == "" || count[ws] > count[best] {
+			best = ws
+		}
+	}
+	return best
+}
+
+// mixedIndent reports whether the block's directives are indented with tabs
+// on some lines and spaces on others (or both on one line).
+func mixedIndent(lines []string, b hostBlock) bool {
+	tabs, spaces := false, false
+	for _, line := range lines[b.Start+1 : b.End] {
+		if _, _, ok := parseDirective(line); !ok {
+			continue
+		}
+		ws := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		tabs = tabs || strings.Contains(ws, "\t")
+		spaces = spaces || strings.Contains(ws, " ")
+	}
+	return tabs && spaces
+}
+
+// sshPath resolves a path written in a user config the way ssh does: ~ is
+// the home directory and relative paths are taken from ~/.ssh.
+func sshPath(p string) string {
+	home, _ := os.UserHomeDir()
+	p = strings.Trim(p, `"`)
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return filepath.Join(home, p[1:])
+	}
+	if !filepath.IsAbs(p) {
+		return filepath.Join(home, ".ssh", p)
+	}
+	return p
+}
+
+// maxIncludeDepth is how deeply walkConfig follows nested Includes, the
+// same limit ssh uses.
+const maxIncludeDepth = 16
+
+// walkConfig calls visit for each line of config and of the files it
+// includes, in the order ssh reads them: the files of an Include are
+// visited right after its line, wherever it appears, nested up to
+// maxIncludeDepth. n is the line's index in file.
+func walkConfig(config string, visit func(file string, n int, line string)) {
+	walkIncludes(config, visit, nil)
+}
+
+// walkIncludes is walkConfig that also calls done, if set, once the files
+// of the Include on line n of file have been walked.
+func walkIncludes(config string, visit func(file string, n int, line string), done func(file string, n int)) {
+	var walk func(path string, depth int)
+	walk = func(path string, depth int) {
+		data, err := os.ReadFile(path)
+		if err != nil || depth > maxIncludeDepth {
+			return
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			visit(path, i, line)
+			k, v, ok := parseDirective(line)
+			if !ok || !strings.EqualFold(k, "include") {
+				continue
+			}
+			for _, pat := range strings.Fields(v) {
+				matches, _ := filepath.Glob(sshPath(pat))
+				for _, m := range matches {
+					walk(m, depth+1)
+				}
+			}
+			if done != nil {
+				done(path, i)
+			}
+		}
+	}
+	walk(config, 0)
+}
+
+// readConfigLines returns the lines of config with those of each included
+// file in place of its Include line's position, as ssh reads them. After an
+// included file, the including file's current Host or Match line is
+// repeated (Host * before its first one), so a block opened in the included
+// file ends there, as ssh restores its state after an Include. It is for
+// looking settings up; edits must work on the files themselves.
+func readConfigLines(config string) ([]string, error) {
+	if _, err := os.Stat(config); err != nil {
+		return nil, err
+	}
+	var lines []string
+	header := map[string]string{}
+	walkIncludes(config, func(file string, n int, line string) {
+		if n == 0 {
+			header[file] = "Host *"
+		}
+		if k, _, ok := parseDirective(line); ok && (strings.EqualFold(k, "host") || strings.EqualFold(k, "match")) {
+			header[file] = line
+		}
+		lines = append(lines, line)
+	}, func(file string, n int) {
+		lines = append(lines, header[file])
+	})
+	return lines, nil
+}
+
+// includedFiles returns the files the config includes, directly or through
+// other included files, in the order ssh reads them.
+func includedFiles(config string) []string {
+	var files []string
+	walkConfig(config, func(file string, n int, line string) {
+		if n == 0 && file != config && !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	})
+	return files
+}
+
+// configLocation is a line of a config file.
+type configLocation struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// findDefinitions returns the absolute path and line number of every Host
+// line that lists alias, in the order ssh reads them, following Includes as
+// includedFiles does.
+func findDefinitions(config, alias string) []configLocation {
+	var locs []configLocation
+	walkConfig(config, func(file string, n int, line string) {
+		k, v, ok := parseDirective(line)
+		if ok && strings.EqualFold(k, "host") && slices.Contains(strings.Fields(v), alias) {
+			abs, _ := filepath.Abs(file)
+			locs = append(locs, configLocation{abs, n + 1})
+		}
+	})
+	return locs
+}
+
+// writeFileAtomic replaces the contents of path by writing a temporary file
+// and renaming it into place. If path is a symlink, the file it points to is
+// replaced instead, so the link itself survives. The file keeps its current
+// permissions, or gets mode 0600 if it is new.
+func writeFileAtomic(path string, data []byte) error {
+	target, err := filepath.EvalSymlinks(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		target = path
+	case err != nil:
+		return err
+	}
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(target); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), target)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteFileAtomicKeepsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "config")
+	if err := os.Mkdir(filepath.Dir(target), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, target, "Host old\n    HostName 10.0.0.1\n")
+	link := filepath.Join(dir, "config")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Host new\n    HostName 10.0.0.2\n"
+	if err := writeFileAtomic(link, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("%s is no longer a symlink (mode %v)", link, fi.Mode())
+	}
+	if got := readFile(t, target); got != want {
+		t.Errorf("target holds %q, want %q", got, want)
+	}
+	if fi, err := os.Stat(target); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("target mode = %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+func TestConfigValue(t *testing.T) {
+	tests := []struct {
+		key, value, want string
+	}{
+		{"IdentityFile", "/home/me/My Keys/id", `"/home/me/My Keys/id"`},
+		{"IdentityFile", "/home/me/.ssh/id_ed25519", "/home/me/.ssh/id_ed25519"},
+		{"IdentityFile", `"/home/me/My Keys/id"`, `"/home/me/My Keys/id"`},
+		{"IdentityAgent", "~/Library/Group Containers/agent.sock", `"~/Library/Group Containers/agent.sock"`},
+		{"LocalForward", "8080 localhost:80", "8080 localhost:80"},
+		{"localforward", "8080 localhost:80", "8080 localhost:80"},
+		{"ProxyCommand", "ssh -W %h:%p bastion", "ssh -W %h:%p bastion"},
+	}
+	for _, tt := range tests {
+		if got := configValue(tt.key, tt.value); got != tt.want {
+			t.Errorf("configValue(%s, %q) = %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBlockIndent(t *testing.T) {
+	tests := []struct {
+		name, config string
+		indent       string
+		mixed        bool
+	}{
+		{"all tabs", "Host web\n\tHostName 10.0.0.1\n\tUser ubuntu\n", "\t", false},
+		{"all spaces", "Host web\n  HostName 10.0.0.1\n  User ubuntu\n", "  ", false},
+		{"mostly tabs", "Host web\n\tHostName 10.0.0.1\n    User ubuntu\n\tPort 2222\n", "\t", true},
+		{"tab and spaces on one line", "Host web\n\t  HostName 10.0.0.1\n", "\t  ", true},
+		{"tie picks the first", "Host web\n    HostName 10.0.0.1\n\tUser ubuntu\n", "    ", true},
+		{"comments and blank lines ignored", "Host web\n\tHostName 10.0.0.1\n    # note\n  \n", "\t", false},
+		{"not indented", "Host web\nHostName 10.0.0.1\n", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := strings.Split(tt.config, "\n")
+			b, ok := findBlock(lines, "web")
+			if !ok {
+				t.Fatal("no block for web")
+			}
+			if got := blockIndent(lines, b); got != tt.indent {
+				t.Errorf("blockIndent = %q, want %q", got, tt.indent)
+			}
+			if got := mixedIndent(lines, b); got != tt.mixed {
+				t.Errorf("mixedIndent = %v, want %v", got, tt.mixed)
+			}
+		})
+	}
+}
+
+func TestHostMatchesNegation(t *testing.T) {
+	tests := []struct {
+		patterns, alias string
+		want            bool
+	}{
+		{"* !bastion", "bastion", false},
+		{"* !bastion", "web", true},
+		{"!bastion *", "bastion", false},
+		{"web-* !web-test", "web-prod", true},
+		{"web-* !web-test", "web-test", false},
+		{"!bastion", "web", false}, // only negations never match
+		{"!bastion", "bastion", false},
+		{"!bastion !jump", "web", false},
+		{"* !BASTION", "bastion", false},
+	}
+	for _, tt := range tests {
+		if got := hostMatches(strings.Fields(tt.patterns), tt.alias); got != tt.want {
+			t.Errorf("hostMatches(%q, %s) = %v, want %v", tt.patterns, tt.alias, got, tt.want)
+		}
+	}
+}
+
+func TestResolveLinesNegatedBlockFirst(t *testing.T) {
+	config := `Host * !bastion
+    User deploy
+    ProxyJump bastion
+
+Host bastion web
+    User admin
+    HostName 10.0.0.1
+`
+	lines := strings.Split(config, "\n")
+	tests := []struct {
+		alias, key, want string
+	}{
+		// The negated block comes first, so its values win for web...
+		{"web", "User", "deploy"},
+		{"web", "ProxyJump", "bastion"},
+		{"web", "HostName", "10.0.0.1"},
+		// ...but bastion is excluded from it and gets its own.
+		{"bastion", "User", "admin"},
+		{"bastion", "ProxyJump", ""},
+		{"bastion", "HostName", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := lookup(resolveLines(lines, tt.alias), tt.key); got != tt.want {
+			t.Errorf("%s %s = %q, want %q", tt.alias, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestManagedRegionBlocks(t *testing.T) {
+	config := `Host mine
+    HostName 10.0.0.9
+
+# >>> ssh-tools managed >>>
+Host web
+    HostName 10.0.0.1
+# Host old
+#     HostName 10.0.0.2
+# <<< ssh-tools managed <<<
+`
+	lines := strings.Split(config, "\n")
+	begin, end, ok := managedRegion(lines)
+	if !ok || begin != 3 || end != 8 {
+		t.Fatalf("managedRegion = %d, %d, %v; want 3, 8, true", begin, end, ok)
+	}
+	for alias, inside := range map[string]bool{"mine": false, "web": true} {
+		b, _ := findBlock(lines, alias)
+		if b.inRegion(begin, end) != inside {
+			t.Errorf("%s in region = %v, want %v", alias, !inside, inside)
+		}
+		if b.End > end {
+			t.Errorf("%s runs past the end marker (to line %d)", alias, b.End)
+		}
+	}
+	b, ok := findDisabledBlock(lines, "old")
+	if !ok || b.Start != 6 || b.End != 8 {
+		t.Errorf("findDisabledBlock(old) = %+v, %v; want lines 6 to 8", b, ok)
+	}
+}
+
+func TestIncludesFollowedAlike(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	top := filepath.Join(dir, "top.conf")
+	nested := filepath.Join(dir, "nested.conf")
+	inBlock := filepath.Join(dir, "inblock.conf")
+	writeFile(t, config, "Include "+top+"\n\nHost web\n    HostName 10.0.0.1\n    Include "+inBlock+"\n")
+	writeFile(t, top, "Include "+nested+"\nHost db\n")
+	writeFile(t, nested, "Host web\n    User deploy\n")
+	writeFile(t, inBlock, "Host web cache\n")
+
+	want := []string{top, nested, inBlock}
+	if got := includedFiles(config); !slices.Equal(got, want) {
+		t.Errorf("includedFiles = %q, want %q", got, want)
+	}
+
+	// findDefinitions sees the same files, in ssh's reading order.
+	wantLocs := []configLocation{{nested, 1}, {config, 3}, {inBlock, 1}}
+	if got := findDefinitions(config, "web"); !slices.Equal(got, wantLocs) {
+		t.Errorf("findDefinitions(web) = %v, want %v", got, wantLocs)
+	}
+	var files []string
+	for _, f := range includedFiles(config) {
+		if owners, _, _ := findOwners([]string{f}, "cache"); len(owners) > 0 {
+			files = append(files, f)
+		}
+	}
+	if locs := findDefinitions(config, "cache"); len(locs) != 1 || !slices.Equal(files, []string{locs[0].File}) {
+		t.Errorf("cache: findOwners in %q, findDefinitions %v", files, locs)
+	}
+}
+
+func TestIncludeLoopStops(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config")
+	writeFile(t, config, "Include "+config+"\nHost web\n")
+	// Reaching here at all means the walk stopped.
+	if len(findDefinitions(config, "web")) == 0 {
+		t.Error("web not found")
+	}
+}
+
+func TestListHostsFollowsIncludes(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	web := filepath.Join(dir, "web.conf")
+	writeFile(t, config, "Include "+web+"\n\nHost *\n    User admin\n\nHost db\n    HostName 10.0.0.2\n")
+	writeFile(t, web, "Host web web-*\n    HostName 10.0.0.1\n")
+
+	hosts, err := listHostsInOrder(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"web", "db"}; !slices.Equal(hosts, want) {
+		t.Errorf("listHostsInOrder = %q, want %q", hosts, want)
+	}
+	opts, err := resolveHost(config, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hn, u := lookup(opts, "HostName"), lookup(opts, "User"); hn != "10.0.0.1" || u != "admin" {
+		t.Errorf("web resolves to HostName %q, User %q; want 10.0.0.1, admin", hn, u)
+	}
+
+	// A Host block in an included file ends with the file: the settings
+	// after the Include apply where they would without it.
+	orb := filepath.Join(dir, "orb.conf")
+	writeFile(t, config, "Include "+orb+"\nHashKnownHosts yes\nUser admin\n\nHost web\n    HostName 10.0.0.1\n")
+	writeFile(t, orb, "Host orb\n    HostName orb.local\n")
+	opts, err = resolveHost(config, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, h := lookup(opts, "User"), lookup(opts, "HashKnownHosts"); u != "admin" || h != "yes" {
+		t.Errorf("web resolves to User %q, HashKnownHosts %q; want admin, yes", u, h)
+	}
+	if inc := lookup(opts, "Include"); inc != "" {
+		t.Errorf("Include resolved as an option: %q", inc)
+	}
+	if opts, _ := resolveHost(config, "orb"); lookup(opts, "User") != "admin" {
+		t.Errorf("orb misses the settings after its Include: %v", opts)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is one of the tools bundled in the ssht binary.
+type command struct {
+	name   string // subcommand, as in "ssht add"
+	binary string // standalone name the binary may be installed as
+	help   string
+	run    func(args []string)
+}
+
+var commands = []command{
+	{"menu", "ssh-menu", "pick a host and connect to it", menuMain},
+	{"add", "ssh-add-host", "add or edit a host in the SSH config", addMain},
+	{"remove", "ssh-remove-host", "remove a host from the SSH config", removeMain},
+}
+
+// prog is the name the running command uses in usage messages.
+var prog string
+
+func sshtUsage() {
+	fmt.Printf("Usage: %s [--config path] <command> [args...]\n\nCommands:\n", prog)
+	for _, c := range commands {
+		fmt.Printf("  %-8s %s (same as %s)\n", c.name, c.help, c.binary)
+	}
+	fmt.Printf(`
+Options shared by all commands:
+  --config path             SSH config to use (default: $SSH_CONFIG or ~/.ssh/config)
+  --context name            use the config of a context from the defaults file
+  --list-contexts           list the contexts and their config files
+  --print-config-path       print the config path that would be used and exit
+  --print-known-hosts-path  print the known_hosts path and exit
+
+Run "%s <command> --help" for the options of a command.
+`, prog)
+}
+
+// printPath is set by --print-config-path or --print-known-hosts-path.
+var printPath string
+
+// contextName is the --context given, if any; listContexts is set by
+// --list-contexts.
+var (
+	contextName  string
+	listContexts bool
+)
+
+// takeSharedFlags removes the options shared by all commands from args, up
+// to a "--" separator: --config path (or --config=path), recorded for
+// sshConfigPath, --context name, --list-contexts and the --print-*-path
+// flags.
+func takeSharedFlags(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			return append(out, args[i:]...)
+		case a == "--config" || a == "-config":
+			if i+1 == len(args) {
+				fmt.Fprintln(os.Stderr, "--config requires a path")
+				os.Exit(2)
+			}
+			configOverride = args[i+1]
+			i++
+		case strings.HasPrefix(a, "--config="), strings.HasPrefix(a, "-config="):
+			configOverride = a[strings.Index(a, "=")+1:]
+		case a == "--context":
+			if i+1 == len(args) {
+				fmt.Fprintln(os.Stderr, "--context requires a name")
+				os.Exit(2)
+			}
+			contextName = args[i+1]
+			i++
+		case strings.HasPrefix(a, "--context="):
+			contextName = strings.TrimPrefix(a, "--context=")
+		case a == "--list-contexts":
+			listContexts = true
+		case a == "--print-config-path" || a == "--print-known-hosts-path":
+			printPath = a
+		default:
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// isDir reports whether path exists and is a directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// useContext handles --list-contexts and points sshConfigPath at the
+// config of the --context given.
+func useContext() {
+	d, err := loadDefaults()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listContexts {
+		if len(d.contexts) == 0 {
+			fmt.Printf("No contexts defined; add \"Context name path\" lines to %s.\n", d.path)
+			os.Exit(0)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, c := range d.contexts {
+			path, err := d.contextConfig(c.Key)
+			if err != nil {
+				path = fmt.Sprintf("%s (no config file)", sshPath(c.Value))
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", c.Key, path)
+		}
+		tw.Flush()
+		os.Exit(0)
+	}
+	if configOverride != "" {
+		log.Fatal("--context and --config cannot be combined")
+	}
+	if configOverride, err = d.contextConfig(contextName); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	base := filepath.Base(os.Args[0])
+	args := takeSharedFlags(os.Args[1:])
+
+	if contextName != "" || listContexts {
+		useContext()
+	}
+
+	switch printPath {
+	case "--print-config-path":
+		fmt.Println(sshConfigPath())
+		return
+	case "--print-known-hosts-path":
+		fmt.Println(knownHostsPath())
+		return
+	}
+
+	// A directory here is a common slip (SSH_CONFIG=~/.ssh); every tool
+	// would otherwise fail with a confusing read error. --metrics reports
+	// it as a config in bad shape instead, so scrapes keep exiting 0.
+	if config, err := configPath(); err == nil && isDir(config) && !slices.Contains(args, "--metrics") {
+		fmt.Fprintf(os.Stderr, "The SSH config %s is a directory; point --config or SSH_CONFIG at a file such as %s.\n",
+			config, filepath.Join(config, "config"))
+		os.Exit(2)
+	}
+
+	// Installed as ssh-menu, ssh-add-host, ... (possibly with an arch
+	// suffix): behave as that tool.
+	for _, c := range commands {
+		if strings.HasPrefix(base, c.binary) {
+			prog = base
+			c.run(args)
+			return
+		}
+	}
+
+	prog = base
+	if len(args) == 0 {
+		sshtUsage()
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "-h", "--help", "help":
+		sshtUsage()
+		return
+	}
+	for _, c := range commands {
+		if args[0] == c.name {
+			prog = base + " " + c.name
+			c.run(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", base, args[0])
+	sshtUsage()
+	os.Exit(2)
+}
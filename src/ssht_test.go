@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIsDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config")
+	writeFile(t, file, "")
+
+	tests := []struct {
+		name, path string
+		want       bool
+	}{
+		{"config is a directory", dir, true},
+		{"config is a file", file, false},
+		{"config is missing", filepath.Join(dir, "missing"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDir(tt.path); got != tt.want {
+				t.Errorf("isDir(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+// useConfig points sshConfigPath at config for the rest of the test.
+func useConfig(t *testing.T, config string) {
+	t.Helper()
+	old := configOverride
+	configOverride = config
+	t.Cleanup(func() { configOverride = old })
+}
+
+func TestSSHConfigPathDirectoryFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	useConfig(t, "")
+	t.Setenv("SSH_CONFIG", dir)
+	if !isDir(sshConfigPath()) {
+		t.Errorf("SSH_CONFIG=%s is not reported as a directory", dir)
+	}
+}